@@ -5,71 +5,184 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"encoding/xml"
-	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/redbluescreen/sbrwxmpp/chatlog"
 	"github.com/redbluescreen/sbrwxmpp/config"
 	"github.com/redbluescreen/sbrwxmpp/db"
+	"github.com/redbluescreen/sbrwxmpp/log"
 	xmlstream "github.com/redbluescreen/sbrwxmpp/xmlstream2"
 	"github.com/redbluescreen/sbrwxmpp/xmpp"
 )
 
 type Server struct {
-	XMPP   *xmpp.XmppServer
-	DB     *db.DB
-	Config *config.Config
-	Logger *log.Logger
+	XMPP    *xmpp.XmppServer
+	DB      *db.DB
+	Config  *config.Store
+	Logger  *log.Logger
+	ChatLog *chatlog.ChatLog
+	// Reload reloads the configuration file and returns the changed
+	// fields that need a restart
+	Reload func() ([]string, error)
 }
 
-func (s Server) Run() {
+// shutdownTimeout is how long running requests may take after the server
+// is asked to stop
+const shutdownTimeout = 5 * time.Second
+
+// Run serves the API until ctx is done. It returns once running requests
+// have finished.
+func (s Server) Run(ctx context.Context) error {
 	mux := mux.NewRouter()
 	mux.HandleFunc("/api/sessions", s.getSessions).Methods("GET")
 	mux.HandleFunc("/api/rooms", s.getRooms).Methods("GET")
 	mux.HandleFunc("/api/users/{to}/message", s.sendMessage(false)).Methods("POST")
 	mux.HandleFunc("/api/rooms/{to}/message", s.sendMessage(true)).Methods("POST")
+	mux.HandleFunc("/api/rooms/{room}", s.putRoom).Methods("PUT")
+	mux.HandleFunc("/api/rooms/{room}", s.deleteRoom).Methods("DELETE")
+	mux.HandleFunc("/api/rooms/{room}/subject", s.setRoomSubject).Methods("PUT")
+	mux.HandleFunc("/api/rooms/{room}/occupants", s.getOccupants).Methods("GET")
+	mux.HandleFunc("/api/rooms/{room}/occupants/{nick}", s.getOccupant).Methods("GET")
+	mux.HandleFunc("/api/rooms/{room}/affiliations", s.getRoomAffiliations).Methods("GET")
+	mux.HandleFunc("/api/rooms/{room}/affiliations/{user}", s.setRoomAffiliation).Methods("PUT")
+	mux.HandleFunc("/api/users", s.getUsers).Methods("GET")
 	mux.HandleFunc("/api/users", s.upsertUser).Methods("POST")
+	mux.HandleFunc("/api/users/bulk", s.bulkUsers).Methods("POST")
+	mux.HandleFunc("/api/users/{user}", s.getUser).Methods("GET")
 	mux.HandleFunc("/api/users/{user}", s.deleteUser).Methods("DELETE")
 	mux.HandleFunc("/api/users/{user}/kick", s.kickUser).Methods("POST")
+	mux.HandleFunc("/api/bans", s.getBans).Methods("GET")
+	mux.HandleFunc("/api/bans", s.addBan).Methods("POST")
+	mux.HandleFunc("/api/bans/{id}", s.deleteBan).Methods("DELETE")
+	mux.HandleFunc("/api/mutes", s.getMutes).Methods("GET")
+	mux.HandleFunc("/api/mutes", s.addMute).Methods("POST")
+	mux.HandleFunc("/api/mutes/{id}", s.deleteMute).Methods("DELETE")
+	mux.HandleFunc("/api/chatlog", s.searchChatLog).Methods("GET")
+	mux.HandleFunc("/api/config/reload", s.reloadConfig).Methods("POST")
+	mux.HandleFunc("/api/events", s.streamEvents(ctx)).Methods("GET")
+	mux.HandleFunc("/metrics", s.getMetrics).Methods("GET")
 	mux.PathPrefix("/debug/pprof/").Handler(http.DefaultServeMux)
 	mux.Use(loggerMiddleware(s.Logger))
-	mux.Use(authMiddleware(s.Config.API.Key))
-	http.ListenAndServe(s.Config.API.Addr, mux)
+	mux.Use(authMiddleware(s.Config))
+	srv := &http.Server{Addr: s.Config.Get().API.Addr, Handler: mux}
+	stopped := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		stopped <- srv.Shutdown(sctx)
+	}()
+	err := srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return <-stopped
+}
+
+type sessionInfo struct {
+	JID           string    `json:"jid"`
+	Username      string    `json:"username"`
+	Resource      string    `json:"resource"`
+	IP            string    `json:"ip"`
+	ConnectedAt   time.Time `json:"connectedAt"`
+	Authenticated bool      `json:"authenticated"`
+	TLSVersion    string    `json:"tlsVersion,omitempty"`
+	TLSCipher     string    `json:"tlsCipher,omitempty"`
+	Rooms         []string  `json:"rooms"`
+	BytesIn       uint64    `json:"bytesIn"`
+	BytesOut      uint64    `json:"bytesOut"`
+	StanzasIn     uint64    `json:"stanzasIn"`
+	StanzasOut    uint64    `json:"stanzasOut"`
+	LastActivity  time.Time `json:"lastActivity"`
 }
 
+// getSessions lists the user names of connected clients, optionally only
+// those of a user or those in a room. With details=true the state and
+// counters of every session are returned instead.
 func (s Server) getSessions(rw http.ResponseWriter, r *http.Request) {
-	s.XMPP.Lock()
-	sessions := make([]string, len(s.XMPP.Clients))
-	for i, client := range s.XMPP.Clients {
-		sessions[i] = strings.Split(client.JID, "@")[0]
+	user := r.URL.Query().Get("user")
+	room := r.URL.Query().Get("room")
+	details := r.URL.Query().Get("details") == "true"
+	names := []string{}
+	sessions := []sessionInfo{}
+	for _, client := range s.XMPP.Sessions() {
+		info := client.Info()
+		username := strings.Split(info.JID, "@")[0]
+		if user != "" && !strings.EqualFold(username, user) {
+			continue
+		}
+		rooms := make([]string, len(info.Rooms))
+		inRoom := false
+		for i, joined := range info.Rooms {
+			rooms[i] = strings.Split(joined.JID, "@")[0]
+			inRoom = inRoom || strings.EqualFold(rooms[i], room)
+		}
+		if room != "" && !inRoom {
+			continue
+		}
+		if !details {
+			names = append(names, username)
+			continue
+		}
+		sessions = append(sessions, sessionInfo{
+			JID:           info.JID,
+			Username:      username,
+			Resource:      info.Resource,
+			IP:            info.IP,
+			ConnectedAt:   info.ConnectedAt,
+			Authenticated: info.Authenticated,
+			TLSVersion:    info.TLSVersion,
+			TLSCipher:     info.TLSCipher,
+			Rooms:         rooms,
+			BytesIn:       info.BytesIn,
+			BytesOut:      info.BytesOut,
+			StanzasIn:     info.StanzasIn,
+			StanzasOut:    info.StanzasOut,
+			LastActivity:  info.LastActivity,
+		})
 	}
-	s.XMPP.Unlock()
 	rw.Header().Set("Content-Type", "application/json")
+	if !details {
+		json.NewEncoder(rw).Encode(names)
+		return
+	}
 	json.NewEncoder(rw).Encode(sessions)
 }
 
 func (s Server) getRooms(rw http.ResponseWriter, r *http.Request) {
 	type roomInfo struct {
-		Name    string   `json:"name"`
-		Members []string `json:"members"`
-	}
-	s.XMPP.Lock()
-	rooms := make([]roomInfo, len(s.XMPP.Rooms))
-	for i, room := range s.XMPP.Rooms {
-		members := make([]string, len(room.Members))
-		for i, member := range room.Members {
+		Name    string         `json:"name"`
+		Members []string       `json:"members"`
+		Subject string         `json:"subject"`
+		Options db.RoomOptions `json:"options"`
+	}
+	xmppRooms := s.XMPP.Rooms()
+	rooms := make([]roomInfo, len(xmppRooms))
+	for i, room := range xmppRooms {
+		roomMembers := room.Members()
+		members := make([]string, len(roomMembers))
+		for i, member := range roomMembers {
 			members[i] = strings.Split(member.JID, "@")[0]
 		}
+		subject, _ := room.Subject()
+		options := room.Options()
+		// Leave out the password, it is omitted when empty
+		options.Password = ""
 		rooms[i] = roomInfo{
 			Name:    strings.Split(room.JID, "@")[0],
 			Members: members,
+			Subject: subject,
+			Options: options,
 		}
 	}
-	s.XMPP.Unlock()
 	rw.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(rw).Encode(rooms)
 }
@@ -112,9 +225,9 @@ func (s Server) sendMessage(room bool) func(http.ResponseWriter, *http.Request)
 		el.SetAttr("from", body.From)
 		var service string
 		if room {
-			service = "conference." + s.Config.Domain
+			service = "conference." + s.Config.Get().Domain
 		} else {
-			service = s.Config.Domain
+			service = s.Config.Get().Domain
 		}
 		el.SetAttr("to", mux.Vars(r)["to"]+"@"+service)
 		if room {
@@ -124,25 +237,157 @@ func (s Server) sendMessage(room bool) func(http.ResponseWriter, *http.Request)
 	}
 }
 
-func (s Server) upsertUser(rw http.ResponseWriter, r *http.Request) {
-	var body struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+type userInfo struct {
+	Username    string    `json:"username"`
+	CreatedAt   time.Time `json:"createdAt"`
+	LastLogin   time.Time `json:"lastLogin"`
+	LastIP      string    `json:"lastIp"`
+	PersonaID   int64     `json:"personaId"`
+	DisplayName string    `json:"displayName"`
+	Banned      bool      `json:"banned"`
+	Muted       bool      `json:"muted"`
+	Admin       bool      `json:"admin"`
+	Online      bool      `json:"online"`
+}
+
+func newUserInfo(u *db.User) userInfo {
+	return userInfo{
+		Username:    u.Name,
+		CreatedAt:   u.CreatedAt,
+		LastLogin:   u.LastLogin,
+		LastIP:      u.LastIP,
+		PersonaID:   u.PersonaID,
+		DisplayName: u.DisplayName,
+		Banned:      u.Flags.Has(db.UserBanned),
+		Muted:       u.Flags.Has(db.UserMuted),
+		Admin:       u.Flags.Has(db.UserAdmin),
 	}
+}
+
+const (
+	defaultUsersLimit = 100
+	maxUsersLimit     = 1000
+)
+
+// getUsers lists users in name order. The next field of the response is
+// the cursor of the following page, it is empty on the last page.
+func (s Server) getUsers(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := defaultUsersLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxUsersLimit {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	users, more, err := s.DB.ListUsers(query.Get("prefix"), query.Get("cursor"), limit)
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var result struct {
+		Users []userInfo `json:"users"`
+		Next  string     `json:"next,omitempty"`
+	}
+	result.Users = make([]userInfo, len(users))
+	domain := s.Config.Get().Domain
+	for i, user := range users {
+		result.Users[i] = newUserInfo(user)
+		result.Users[i].Online = len(s.XMPP.UserSessions(user.Name+"@"+domain)) > 0
+	}
+	if more {
+		result.Next = users[len(users)-1].Name
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(result)
+}
+
+func (s Server) getUser(rw http.ResponseWriter, r *http.Request) {
+	user, err := s.DB.GetUser(mux.Vars(r)["user"])
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	result := struct {
+		userInfo
+		// Sessions are the full JIDs of the connected clients
+		Sessions []string `json:"sessions"`
+		Rooms    []string `json:"rooms"`
+	}{
+		userInfo: newUserInfo(user),
+		Sessions: []string{},
+		Rooms:    []string{},
+	}
+	joined := make(map[*xmpp.XmppRoom]bool)
+	for _, client := range s.XMPP.UserSessions(user.Name + "@" + s.Config.Get().Domain) {
+		result.Sessions = append(result.Sessions, client.JID)
+		for _, room := range client.JoinedRooms() {
+			if !joined[room] {
+				joined[room] = true
+				result.Rooms = append(result.Rooms, strings.Split(room.JID, "@")[0])
+			}
+		}
+	}
+	result.Online = len(result.Sessions) > 0
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(result)
+}
+
+// userUpdate is the body of a user upsert. Fields that are left out keep
+// their stored value.
+type userUpdate struct {
+	Username    string  `json:"username"`
+	Password    *string `json:"password"`
+	PersonaID   *int64  `json:"personaId"`
+	DisplayName *string `json:"displayName"`
+	Banned      *bool   `json:"banned"`
+	Muted       *bool   `json:"muted"`
+	Admin       *bool   `json:"admin"`
+}
+
+func (b userUpdate) apply(u *db.User) error {
+	if b.Password != nil {
+		u.Password = []byte(*b.Password)
+	}
+	if b.PersonaID != nil {
+		u.PersonaID = *b.PersonaID
+	}
+	if b.DisplayName != nil {
+		u.DisplayName = *b.DisplayName
+	}
+	if b.Banned != nil {
+		u.Flags.Set(db.UserBanned, *b.Banned)
+	}
+	if b.Muted != nil {
+		u.Flags.Set(db.UserMuted, *b.Muted)
+	}
+	if b.Admin != nil {
+		u.Flags.Set(db.UserAdmin, *b.Admin)
+	}
+	return nil
+}
+
+func (s Server) upsertUser(rw http.ResponseWriter, r *http.Request) {
+	var body userUpdate
 	err := json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
 		s.Logger.Printf("error handling request: %v", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if !jidNodeValid(body.Username) {
+	if !xmpp.NodeValid(body.Username) {
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	err = s.DB.UpsertUser(db.User{
-		Name:     body.Username,
-		Password: []byte(body.Password),
-	})
+	err = s.DB.UpdateUser(body.Username, body.apply)
 	if err != nil {
 		s.Logger.Printf("error handling request: %v", err)
 		rw.WriteHeader(http.StatusInternalServerError)
@@ -160,18 +405,7 @@ func (s Server) deleteUser(rw http.ResponseWriter, r *http.Request) {
 }
 
 func (s Server) kickUser(rw http.ResponseWriter, r *http.Request) {
-	s.XMPP.Lock()
-	for _, client := range s.XMPP.Clients {
-		if strings.Split(client.JID, "/")[0] == mux.Vars(r)["user"]+"@"+s.Config.Domain {
-			client.CloseError("<not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>")
-		}
-	}
-	s.XMPP.Unlock()
-}
-
-func jidNodeValid(s string) bool {
-	if len(s) == 0 || len(s) > 256 {
-		return false
+	for _, client := range s.XMPP.UserSessions(mux.Vars(r)["user"] + "@" + s.Config.Get().Domain) {
+		client.Kick("api", "<not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>")
 	}
-	return !strings.ContainsAny(s, "\"&'/:<>@\u007F\uFFFE\uFFFF")
 }
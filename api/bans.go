@@ -0,0 +1,101 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redbluescreen/sbrwxmpp/db"
+	"github.com/redbluescreen/sbrwxmpp/xmpp"
+)
+
+func (s Server) getBans(rw http.ResponseWriter, r *http.Request) {
+	bans, err := s.DB.GetBans()
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	result := make([]db.Ban, 0, len(bans))
+	user := r.URL.Query().Get("user")
+	for _, ban := range bans {
+		if user == "" || strings.EqualFold(ban.User, user) {
+			result = append(result, ban)
+		}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(result)
+}
+
+func (s Server) addBan(rw http.ResponseWriter, r *http.Request) {
+	var body struct {
+		User     string `json:"user"`
+		IP       string `json:"ip"`
+		Reason   string `json:"reason"`
+		IssuedBy string `json:"issuedBy"`
+		// Duration in seconds, zero for a permanent ban
+		Duration int64 `json:"duration"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if body.User == "" && body.IP == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if (body.User != "" && !xmpp.NodeValid(body.User)) ||
+		(body.IP != "" && net.ParseIP(body.IP) == nil) ||
+		body.Duration < 0 {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ban := db.Ban{
+		User:      body.User,
+		IP:        body.IP,
+		Reason:    body.Reason,
+		IssuedBy:  body.IssuedBy,
+		CreatedAt: time.Now(),
+	}
+	if body.Duration > 0 {
+		ban.ExpiresAt = ban.CreatedAt.Add(time.Duration(body.Duration) * time.Second)
+	}
+	err = s.DB.AddBan(&ban)
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// Closing a connection can block, the ban is in effect already
+	kicked := ban
+	go s.XMPP.KickBanned(&kicked)
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(ban)
+}
+
+func (s Server) deleteBan(rw http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	found, err := s.DB.DeleteBan(id)
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,149 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"unicode"
+
+	"github.com/redbluescreen/sbrwxmpp/db"
+	"github.com/redbluescreen/sbrwxmpp/xmpp"
+)
+
+// bulkBatchSize is the number of users written per transaction
+const bulkBatchSize = 500
+
+type bulkItem struct {
+	userUpdate
+	// Delete removes the user instead of updating it
+	Delete bool `json:"delete"`
+}
+
+type bulkResult struct {
+	Index    int    `json:"index"`
+	Username string `json:"username,omitempty"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+}
+
+// bulkUsers upserts or deletes users given as a JSON array or as
+// newline-delimited JSON objects and returns a result for every item
+func (s Server) bulkUsers(rw http.ResponseWriter, r *http.Request) {
+	body := bufio.NewReader(r.Body)
+	dec := json.NewDecoder(body)
+	array, err := startsWithArray(body)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if array {
+		if _, err := dec.Token(); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	results := []bulkResult{}
+	var writes []db.UserWrite
+	var indexes []int
+	flush := func() error {
+		if len(writes) == 0 {
+			return nil
+		}
+		errs, err := s.DB.WriteUsers(writes)
+		if err != nil {
+			return err
+		}
+		for i, err := range errs {
+			if err != nil {
+				results[indexes[i]].OK = false
+				results[indexes[i]].Error = err.Error()
+			}
+		}
+		writes = writes[:0]
+		indexes = indexes[:0]
+		return nil
+	}
+
+	for i := 0; ; i++ {
+		if array && !dec.More() {
+			break
+		}
+		var item bulkItem
+		err := dec.Decode(&item)
+		if err == io.EOF && !array {
+			break
+		}
+		if err != nil {
+			// The rest of the body can't be parsed
+			results = append(results, bulkResult{Index: i, Error: "invalid JSON: " + err.Error()})
+			break
+		}
+		result := bulkResult{Index: i, Username: item.Username, OK: true}
+		if !xmpp.NodeValid(item.Username) {
+			result.OK = false
+			result.Error = "invalid username"
+			results = append(results, result)
+			continue
+		}
+		write := db.UserWrite{
+			Name:   item.Username,
+			Delete: item.Delete,
+		}
+		if !item.Delete {
+			update := item.userUpdate
+			// Derive the keys here, so that the transaction isn't held
+			// while hashing every password of the batch
+			if update.Password != nil {
+				keys, err := db.NewKeys([]byte(*update.Password))
+				if err != nil {
+					s.Logger.Printf("error handling request: %v", err)
+					rw.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				write.Keys = &keys
+				update.Password = nil
+			}
+			write.Update = update.apply
+		}
+		indexes = append(indexes, len(results))
+		results = append(results, result)
+		writes = append(writes, write)
+		if len(writes) >= bulkBatchSize {
+			if err := flush(); err != nil {
+				s.Logger.Printf("error handling request: %v", err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(results)
+}
+
+// startsWithArray skips leading whitespace and reports whether the body
+// is a JSON array
+func startsWithArray(r *bufio.Reader) (bool, error) {
+	for {
+		c, _, err := r.ReadRune()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !unicode.IsSpace(c) {
+			return c == '[', r.UnreadRune()
+		}
+	}
+}
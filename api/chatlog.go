@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redbluescreen/sbrwxmpp/chatlog"
+)
+
+const (
+	defaultChatLogLimit = 100
+	maxChatLogLimit     = 1000
+)
+
+func (s Server) searchChatLog(rw http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	q := chatlog.Query{
+		User:  qs.Get("user"),
+		Room:  qs.Get("room"),
+		Type:  qs.Get("type"),
+		Text:  qs.Get("q"),
+		Limit: defaultChatLogLimit,
+	}
+	var err error
+	if v := qs.Get("since"); v != "" {
+		q.Since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if v := qs.Get("until"); v != "" {
+		q.Until, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if v := qs.Get("limit"); v != "" {
+		q.Limit, err = strconv.Atoi(v)
+		if err != nil || q.Limit <= 0 || q.Limit > maxChatLogLimit {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	messages, err := s.ChatLog.Search(q)
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(messages)
+}
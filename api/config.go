@@ -0,0 +1,30 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (s Server) reloadConfig(rw http.ResponseWriter, r *http.Request) {
+	if s.Reload == nil {
+		rw.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	restart, err := s.Reload()
+	if err != nil {
+		s.Logger.Printf("error reloading configuration: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if restart == nil {
+		restart = []string{}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(struct {
+		RestartRequired []string `json:"restartRequired"`
+	}{restart})
+}
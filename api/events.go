@@ -0,0 +1,98 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redbluescreen/sbrwxmpp/events"
+)
+
+const (
+	defaultEventBuffer = 256
+	maxEventBuffer     = 4096
+	keepaliveInterval  = 15 * time.Second
+)
+
+// streamEvents sends server events as Server-Sent Events until the client
+// disconnects or ctx is done. Events can be filtered with the types, user
+// and room query parameters, message events are only sent if requested
+// in types.
+func (s Server) streamEvents(ctx context.Context) func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			rw.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		query := r.URL.Query()
+		filter := events.Filter{
+			User: query.Get("user"),
+			Room: query.Get("room"),
+		}
+		if types := query.Get("types"); types != "" {
+			for _, t := range strings.Split(types, ",") {
+				filter.Types = append(filter.Types, events.Type(t))
+			}
+		}
+		size := defaultEventBuffer
+		if b := query.Get("buffer"); b != "" {
+			var err error
+			size, err = strconv.Atoi(b)
+			if err != nil || size <= 0 || size > maxEventBuffer {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		sub := s.XMPP.Events.Subscribe(filter, size)
+		defer s.XMPP.Events.Unsubscribe(sub)
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Header().Set("Cache-Control", "no-cache")
+		rw.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepalive := time.NewTicker(keepaliveInterval)
+		defer keepalive.Stop()
+		var dropped uint64
+		for {
+			var err error
+			select {
+			case e := <-sub.C:
+				err = writeEvent(rw, string(e.Type), e)
+				// Tell the client if it missed events
+				if n := sub.Dropped(); err == nil && n != dropped {
+					err = writeEvent(rw, "dropped", map[string]uint64{"count": n - dropped})
+					dropped = n
+				}
+			case <-keepalive.C:
+				_, err = fmt.Fprint(rw, ": keepalive\n\n")
+			case <-r.Context().Done():
+				return
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(rw http.ResponseWriter, name string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(rw, "event: %v\ndata: %s\n\n", name, body)
+	return err
+}
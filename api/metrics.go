@@ -0,0 +1,19 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/redbluescreen/sbrwxmpp/metrics"
+)
+
+func (s Server) getMetrics(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	err := metrics.WriteText(rw)
+	if err != nil {
+		s.Logger.Printf("error writing metrics: %v", err)
+	}
+}
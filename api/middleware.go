@@ -5,9 +5,11 @@
 package api
 
 import (
-	"log"
 	"net/http"
 	"time"
+
+	"github.com/redbluescreen/sbrwxmpp/config"
+	"github.com/redbluescreen/sbrwxmpp/log"
 )
 
 type loggerWriter struct {
@@ -24,6 +26,13 @@ func (w *loggerWriter) Write(b []byte) (int, error) {
 	return w.ResponseWriter.Write(b)
 }
 
+// Flush is needed for streaming responses
+func (w *loggerWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 type loggerHandler struct {
 	http.Handler
 	Logger *log.Logger
@@ -36,7 +45,13 @@ func (h loggerHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	if lw.status == 0 {
 		lw.status = 200
 	}
-	h.Logger.Printf("[%v] %v %v %v\n", r.Method, r.URL.RequestURI(), lw.status, time.Since(t).String())
+	h.Logger.Event("request").With(log.Fields{
+		"method":     r.Method,
+		"path":       r.URL.RequestURI(),
+		"status":     lw.status,
+		"duration":   time.Since(t).String(),
+		"remoteAddr": r.RemoteAddr,
+	}).Print("Handled API request")
 }
 
 func loggerMiddleware(logger *log.Logger) func(next http.Handler) http.Handler {
@@ -48,11 +63,11 @@ func loggerMiddleware(logger *log.Logger) func(next http.Handler) http.Handler {
 	}
 }
 
-func authMiddleware(token string) func(next http.Handler) http.Handler {
+func authMiddleware(cfg *config.Store) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 			auth := r.Header.Get("Authorization")
-			if auth != token {
+			if auth != cfg.Get().API.Key {
 				rw.WriteHeader(http.StatusUnauthorized)
 				return
 			}
@@ -0,0 +1,94 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redbluescreen/sbrwxmpp/db"
+	"github.com/redbluescreen/sbrwxmpp/xmpp"
+)
+
+func (s Server) getMutes(rw http.ResponseWriter, r *http.Request) {
+	mutes, err := s.DB.GetMutes()
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	result := make([]db.Mute, 0, len(mutes))
+	user := r.URL.Query().Get("user")
+	for _, mute := range mutes {
+		if user == "" || strings.EqualFold(mute.User, user) {
+			result = append(result, mute)
+		}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(result)
+}
+
+func (s Server) addMute(rw http.ResponseWriter, r *http.Request) {
+	var body struct {
+		User string `json:"user"`
+		// Room name, empty to mute in all rooms and private messages
+		Room     string `json:"room"`
+		Reason   string `json:"reason"`
+		IssuedBy string `json:"issuedBy"`
+		// Duration in seconds, zero for a permanent mute
+		Duration int64 `json:"duration"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !xmpp.NodeValid(body.User) || (body.Room != "" && !xmpp.NodeValid(body.Room)) || body.Duration < 0 {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	mute := db.Mute{
+		User:      body.User,
+		Reason:    body.Reason,
+		IssuedBy:  body.IssuedBy,
+		CreatedAt: time.Now(),
+	}
+	if body.Room != "" {
+		mute.Room = body.Room + "@conference." + s.Config.Get().Domain
+	}
+	if body.Duration > 0 {
+		mute.ExpiresAt = mute.CreatedAt.Add(time.Duration(body.Duration) * time.Second)
+	}
+	err = s.DB.AddMute(&mute)
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(mute)
+}
+
+func (s Server) deleteMute(rw http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	found, err := s.DB.DeleteMute(id)
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,205 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/redbluescreen/sbrwxmpp/db"
+	"github.com/redbluescreen/sbrwxmpp/xmpp"
+)
+
+func (s Server) roomJID(name string) string {
+	return s.XMPP.RoomJID(name)
+}
+
+// putRoom creates or reconfigures a room. Persistent rooms are created
+// right away, other rooms get the options when a player creates them.
+func (s Server) putRoom(rw http.ResponseWriter, r *http.Request) {
+	var options db.RoomOptions
+	err := json.NewDecoder(r.Body).Decode(&options)
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	name := mux.Vars(r)["room"]
+	if !xmpp.NodeValid(name) || options.MaxOccupants < 0 {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = s.XMPP.ConfigureRoom(s.roomJID(name), options)
+	if err == xmpp.ErrRoomConfigured {
+		rw.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// deleteRoom destroys a room, removing all occupants, and deletes its
+// stored state
+func (s Server) deleteRoom(rw http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["room"]
+	if !xmpp.NodeValid(name) {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	found, err := s.XMPP.DestroyRoom(s.roomJID(name), r.URL.Query().Get("reason"))
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s Server) setRoomSubject(rw http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Subject string `json:"subject"`
+		// Persist stores the subject so it survives the room being
+		// recreated
+		Persist bool `json:"persist"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	name := mux.Vars(r)["room"]
+	if !xmpp.NodeValid(name) {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	found, err := s.XMPP.SetRoomSubject(s.roomJID(name), body.Subject, "", body.Persist)
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s Server) getRoomAffiliations(rw http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["room"]
+	if !xmpp.NodeValid(name) {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	affiliations, found, err := s.XMPP.RoomAffiliations(s.roomJID(name))
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(affiliations)
+}
+
+// setRoomAffiliation changes the affiliation of a user in a room, for
+// example to make them an owner or to ban them from the room
+func (s Server) setRoomAffiliation(rw http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Affiliation string `json:"affiliation"`
+		// Persist stores the room so the affiliation survives it being
+		// recreated
+		Persist bool `json:"persist"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	name := mux.Vars(r)["room"]
+	user := mux.Vars(r)["user"]
+	if !xmpp.NodeValid(name) || !xmpp.NodeValid(user) || !validAffiliation(body.Affiliation) {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	jid := user + "@" + s.Config.Get().Domain
+	found, err := s.XMPP.SetAffiliation(s.roomJID(name), jid, body.Affiliation, body.Persist)
+	if err != nil {
+		s.Logger.Printf("error handling request: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func validAffiliation(affiliation string) bool {
+	switch affiliation {
+	case xmpp.AffiliationOwner, xmpp.AffiliationAdmin, xmpp.AffiliationMember,
+		xmpp.AffiliationNone, xmpp.AffiliationOutcast:
+		return true
+	default:
+		return false
+	}
+}
+
+type occupantInfo struct {
+	Nick        string `json:"nick"`
+	JID         string `json:"jid"`
+	Username    string `json:"username"`
+	Affiliation string `json:"affiliation"`
+	Role        string `json:"role"`
+}
+
+func newOccupantInfo(o *xmpp.Occupant) occupantInfo {
+	return occupantInfo{
+		Nick:        o.Nick,
+		JID:         o.Client.JID,
+		Username:    strings.Split(o.Client.JID, "@")[0],
+		Affiliation: o.Affiliation,
+		Role:        o.Role,
+	}
+}
+
+// getOccupants lists the occupants of a room with their real JIDs
+func (s Server) getOccupants(rw http.ResponseWriter, r *http.Request) {
+	room := s.XMPP.Room(s.roomJID(mux.Vars(r)["room"]))
+	if room == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	occupants := []occupantInfo{}
+	for _, o := range room.Occupants() {
+		occupants = append(occupants, newOccupantInfo(o))
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(occupants)
+}
+
+// getOccupant maps a nick in a room to the real JID of the occupant
+func (s Server) getOccupant(rw http.ResponseWriter, r *http.Request) {
+	room := s.XMPP.Room(s.roomJID(mux.Vars(r)["room"]))
+	if room == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	o := room.OccupantByNick(mux.Vars(r)["nick"])
+	if o == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(newOccupantInfo(o))
+}
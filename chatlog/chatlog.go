@@ -5,9 +5,15 @@
 package chatlog
 
 import (
+	"encoding/binary"
+	"encoding/json"
 	"encoding/xml"
-	"fmt"
+	"strings"
 	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/redbluescreen/sbrwxmpp/log"
 )
 
 type chatMsgType uint
@@ -18,6 +24,8 @@ func (t chatMsgType) String() string {
 		return "global"
 	case chatMsgTypeEvent:
 		return "event"
+	case chatMsgTypeAnnounce:
+		return "announce"
 	case chatMsgTypeWhisper:
 		return "whisper"
 	case chatMsgTypeGroup:
@@ -28,11 +36,11 @@ func (t chatMsgType) String() string {
 }
 
 const (
-	chatMsgTypeGlobal  chatMsgType = 0
-	chatMsgTypeEvent   chatMsgType = 1
-	chatMsgTypeWhisper chatMsgType = 3
-	chatMsgTypeGroup   chatMsgType = 8
-	// chatMsgTypeAnnounce = 2
+	chatMsgTypeGlobal   chatMsgType = 0
+	chatMsgTypeEvent    chatMsgType = 1
+	chatMsgTypeAnnounce chatMsgType = 2
+	chatMsgTypeWhisper  chatMsgType = 3
+	chatMsgTypeGroup    chatMsgType = 8
 )
 
 type chatMsg struct {
@@ -42,18 +50,270 @@ type chatMsg struct {
 	Message string `xml:"Msg"`
 }
 
-type messageDocument struct {
-	Timestamp time.Time
-	From      string
-	Type      string
-	Message   string
+// SystemMessage returns a ChatMsg body the game shows as an announcement
+func SystemMessage(text string) string {
+	data, _ := xml.Marshal(chatMsg{
+		Type:    uint(chatMsgTypeAnnounce),
+		From:    "System",
+		Message: text,
+	})
+	return string(data)
+}
+
+// Message is a parsed ChatMsg body
+type Message struct {
+	Type string `json:"type"`
+	// Nick is the name the game shows for the sender
+	Nick    string `json:"nick"`
+	Message string `json:"message"`
 }
 
-func ProcessMessage(body string) {
+// ParseMessage parses a ChatMsg body. It returns false if the body is not
+// a ChatMsg.
+func ParseMessage(body string) (Message, bool) {
 	msg := chatMsg{}
-	err := xml.Unmarshal([]byte(body), &msg)
+	if xml.Unmarshal([]byte(body), &msg) != nil {
+		return Message{}, false
+	}
+	return Message{
+		Type:    chatMsgType(msg.Type).String(),
+		Nick:    msg.From,
+		Message: msg.Message,
+	}, true
+}
+
+type MessageDocument struct {
+	Timestamp time.Time `json:"timestamp"`
+	// From is the JID of the sender
+	From string `json:"from"`
+	// To is the room or recipient JID
+	To   string `json:"to"`
+	Type string `json:"type"`
+	// Nick is the name the game shows for the sender
+	Nick    string `json:"nick"`
+	Message string `json:"message"`
+}
+
+const queueSize = 4096
+
+var bucketName = []byte("chatlog")
+
+// ChatLog stores chat messages in the database. Messages are written in
+// batches by a background goroutine.
+type ChatLog struct {
+	db        *bolt.DB
+	logger    *log.Logger
+	retention time.Duration
+	queue     chan MessageDocument
+	done      chan struct{}
+}
+
+// New creates the chatlog bucket and starts the writer. Messages older
+// than retention are removed, zero keeps them forever.
+func New(db *bolt.DB, logger *log.Logger, retention time.Duration) (*ChatLog, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
 	if err != nil {
+		return nil, err
+	}
+	l := &ChatLog{
+		db:        db,
+		logger:    logger,
+		retention: retention,
+		queue:     make(chan MessageDocument, queueSize),
+		done:      make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+// ProcessMessage queues a message parsed by ParseMessage for storage.
+// It never blocks, messages are dropped if the writer can't keep up.
+func (l *ChatLog) ProcessMessage(from, to string, msg Message) {
+	if l == nil {
+		return
+	}
+	doc := MessageDocument{
+		Timestamp: time.Now(),
+		From:      from,
+		To:        to,
+		Type:      msg.Type,
+		Nick:      msg.Nick,
+		Message:   msg.Message,
+	}
+	select {
+	case l.queue <- doc:
+	default:
+		l.logger.Println("chatlog queue full, dropping message")
+	}
+}
+
+// Close writes all queued messages and stops the writer
+func (l *ChatLog) Close() {
+	close(l.queue)
+	<-l.done
+}
+
+func (l *ChatLog) run() {
+	defer close(l.done)
+	purge := time.NewTicker(time.Hour)
+	defer purge.Stop()
+	l.purge()
+	for {
+		select {
+		case doc, ok := <-l.queue:
+			if !ok {
+				return
+			}
+			batch := []MessageDocument{doc}
+			more := true
+			for more && len(batch) < queueSize {
+				select {
+				case doc, ok := <-l.queue:
+					if !ok {
+						more = false
+						break
+					}
+					batch = append(batch, doc)
+				default:
+					more = false
+				}
+			}
+			err := l.write(batch)
+			if err != nil {
+				l.logger.Printf("error writing chatlog: %v", err)
+			}
+		case <-purge.C:
+			l.purge()
+		}
+	}
+}
+
+func (l *ChatLog) write(batch []MessageDocument) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		for _, doc := range batch {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			data, err := json.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			err = b.Put(documentKey(doc.Timestamp, seq), data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (l *ChatLog) purge() {
+	if l.retention <= 0 {
 		return
 	}
-	fmt.Printf("%#v\n", msg)
+	cutoff := timeKey(time.Now().Add(-l.retention))
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketName).Cursor()
+		// Deleting moves the cursor, so start over from the first key
+		for k, _ := c.First(); k != nil && string(k[:8]) < string(cutoff); k, _ = c.First() {
+			err := c.Delete()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		l.logger.Printf("error purging chatlog: %v", err)
+	}
+}
+
+// Keys are the big endian timestamp followed by a sequence number, so
+// that cursors iterate in time order.
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+func documentKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	copy(key, timeKey(t))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+type Query struct {
+	// User matches the local part of the sender JID
+	User string
+	// Room matches the local part of the room or recipient JID
+	Room string
+	Type string
+	// Since and Until limit the time range, zero values are unbounded
+	Since time.Time
+	Until time.Time
+	// Text is matched case insensitively against the message
+	Text  string
+	Limit int
+}
+
+func (q Query) matches(doc *MessageDocument) bool {
+	if q.User != "" && !strings.EqualFold(jidNode(doc.From), q.User) {
+		return false
+	}
+	if q.Room != "" && !strings.EqualFold(jidNode(doc.To), q.Room) {
+		return false
+	}
+	if q.Type != "" && doc.Type != q.Type {
+		return false
+	}
+	return q.Text == "" || strings.Contains(strings.ToLower(doc.Message), strings.ToLower(q.Text))
+}
+
+// Search returns messages matching the query, newest first
+func (l *ChatLog) Search(q Query) ([]MessageDocument, error) {
+	result := make([]MessageDocument, 0)
+	err := l.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketName).Cursor()
+		var k, v []byte
+		if q.Until.IsZero() {
+			k, v = c.Last()
+		} else {
+			// Seek to the first key after Until and step back
+			k, v = c.Seek(timeKey(q.Until.Add(time.Nanosecond)))
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+		var since []byte
+		if !q.Since.IsZero() {
+			since = timeKey(q.Since)
+		}
+		for ; k != nil && (q.Limit <= 0 || len(result) < q.Limit); k, v = c.Prev() {
+			if since != nil && string(k[:8]) < string(since) {
+				break
+			}
+			var doc MessageDocument
+			err := json.Unmarshal(v, &doc)
+			if err != nil {
+				return err
+			}
+			if q.matches(&doc) {
+				result = append(result, doc)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+func jidNode(jid string) string {
+	return strings.Split(jid, "@")[0]
 }
@@ -0,0 +1,71 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package chatlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/redbluescreen/sbrwxmpp/log"
+)
+
+func TestStoreAndSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbrwxmpp-chatlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(path.Join(dir, "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	l, err := New(db, log.New("", false), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for _, m := range []struct{ from, to, body string }{
+		{"sbrw.1@localhost/EA", "channel.en__1@conference.localhost",
+			`<ChatMsg Type="0"><From>Alice</From><Msg>Hello world</Msg></ChatMsg>`},
+		{"sbrw.2@localhost/EA", "sbrw.1@localhost",
+			`<ChatMsg Type="3"><From>Bob</From><Msg>hi alice</Msg></ChatMsg>`},
+	} {
+		msg, ok := ParseMessage(m.body)
+		if !ok {
+			t.Fatalf("failed to parse %v", m.body)
+		}
+		l.ProcessMessage(m.from, m.to, msg)
+	}
+	if _, ok := ParseMessage("not a chatmsg"); ok {
+		t.Error("parsed a body that is not a ChatMsg")
+	}
+	l.Close()
+
+	all, err := l.Search(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].Nick != "Bob" {
+		t.Fatalf("expected 2 messages newest first, got %#v", all)
+	}
+	res, _ := l.Search(Query{Type: "global", Text: "WORLD"})
+	if len(res) != 1 || res[0].From != "sbrw.1@localhost/EA" {
+		t.Fatalf("unexpected search result %#v", res)
+	}
+	res, _ = l.Search(Query{User: "sbrw.2", Room: "sbrw.1"})
+	if len(res) != 1 || res[0].Type != "whisper" {
+		t.Fatalf("unexpected search result %#v", res)
+	}
+	res, _ = l.Search(Query{Until: start})
+	if len(res) != 0 {
+		t.Fatalf("unexpected search result %#v", res)
+	}
+}
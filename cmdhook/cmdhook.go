@@ -5,34 +5,37 @@
 package cmdhook
 
 import (
-	"encoding/xml"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/redbluescreen/sbrwxmpp/config"
+	"github.com/redbluescreen/sbrwxmpp/log"
+	"github.com/redbluescreen/sbrwxmpp/metrics"
 )
 
-type chatMsg struct {
-	XMLName xml.Name `xml:"ChatMsg"`
-	Message string   `xml:"Msg"`
-}
+var (
+	metricDuration = metrics.NewHistogram("sbrwxmpp_webhook_duration_seconds",
+		"Duration of webhook requests.", []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1})
+	metricFailures = metrics.NewCounter("sbrwxmpp_webhook_failures_total",
+		"Webhook requests that failed or returned an error status.")
+)
 
 type CmdHook struct {
 	Client *http.Client
-	Config *config.WebhookConfig
+	Config *config.Store
+	Logger *log.Logger
 }
 
-func (h *CmdHook) ProcessMessage(from string, body string) bool {
-	if h.Config.Target == "" {
-		return false
-	}
-	msg := chatMsg{}
-	err := xml.Unmarshal([]byte(body), &msg)
-	if err != nil {
+// ProcessMessage sends a command to the webhook if message, the text of
+// a ChatMsg, is one. It returns false if the message should be routed.
+func (h *CmdHook) ProcessMessage(from string, message string) bool {
+	cfg := h.Config.Get().Webhook
+	if cfg.Target == "" {
 		return false
 	}
-	if !strings.HasPrefix(msg.Message, "/") {
+	if !strings.HasPrefix(message, "/") {
 		return false
 	}
 	splits := strings.Split(strings.Split(from, "@")[0], ".")
@@ -42,17 +45,29 @@ func (h *CmdHook) ProcessMessage(from string, body string) bool {
 	fromID := splits[1]
 	qs := url.Values{
 		"pid": {fromID},
-		"cmd": {msg.Message},
+		"cmd": {message},
 	}
-	req, err := http.NewRequest("POST", h.Config.Target+"?"+qs.Encode(), nil)
+	logger := h.Logger.With(log.Fields{"pid": fromID})
+	logger.Debug("Sending command to webhook")
+	req, err := http.NewRequest("POST", cfg.Target+"?"+qs.Encode(), nil)
 	if err != nil {
+		logger.Printf("error creating webhook request: %v", err)
 		return true
 	}
-	req.Header.Add("Authorization", h.Config.Secret)
+	req.Header.Add("Authorization", cfg.Secret)
+	start := time.Now()
 	resp, err := h.Client.Do(req)
+	metricDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		metricFailures.Inc()
+		logger.Event("webhook_failed").Printf("error calling webhook: %v", err)
 		return true
 	}
 	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		metricFailures.Inc()
+		logger.Event("webhook_failed").With(log.Fields{"status": resp.StatusCode}).
+			Print("Webhook returned an error status")
+	}
 	return true
 }
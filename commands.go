@@ -0,0 +1,383 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/redbluescreen/sbrwxmpp/certgen"
+	pconfig "github.com/redbluescreen/sbrwxmpp/config"
+	"github.com/redbluescreen/sbrwxmpp/db"
+	"github.com/redbluescreen/sbrwxmpp/xmpp"
+)
+
+var errUsage = errors.New("usage")
+
+type command struct {
+	group, name string
+	usage       string
+	run         func(args []string) error
+}
+
+// commands are admin subcommands working directly on the data directory.
+// They can't run while the server has the database open.
+var commands = []command{
+	{"user", "add", "[-admin] [-persona id] [-display name] <name> [password]", userAdd},
+	{"user", "del", "<name>", userDel},
+	{"user", "list", "", userList},
+	{"user", "passwd", "<name> [password]", userPasswd},
+	{"db", "export", "[file]", dbExport},
+	{"db", "import", "[file]", dbImport},
+	{"db", "compact", "", dbCompact},
+	{"db", "check", "", dbCheck},
+	{"cert", "generate", "[-force] [domain]", certGenerate},
+}
+
+func commandUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [flags] [command]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintln(os.Stderr, strings.TrimSpace("  "+cmd.group+" "+cmd.name+" "+cmd.usage))
+	}
+	fmt.Fprint(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// runCommand runs the subcommand in args and returns the exit code
+func runCommand(args []string) int {
+	for _, cmd := range commands {
+		if len(args) < 2 || cmd.group != args[0] || cmd.name != args[1] {
+			continue
+		}
+		err := cmd.run(args[2:])
+		if err == errUsage {
+			fmt.Fprintln(os.Stderr, strings.TrimSpace("Usage: "+os.Args[0]+" "+cmd.group+" "+cmd.name+" "+cmd.usage))
+			return 2
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v %v: %v\n", cmd.group, cmd.name, err)
+			return 1
+		}
+		return 0
+	}
+	commandUsage()
+	return 2
+}
+
+// openDB opens the database in the data directory. It fails if the
+// server is running.
+func openDB() (*db.DB, error) {
+	bdb, err := bolt.Open(filepath.Join(*dataDir, "sbrwxmpp.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, errors.New("database is in use, stop the server first")
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := &db.DB{DB: bdb}
+	err = d.Initialize()
+	if err != nil {
+		bdb.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// withDB runs fn with the opened database and closes it afterwards
+func withDB(fn func(d *db.DB) error) error {
+	d, err := openDB()
+	if err != nil {
+		return err
+	}
+	err = fn(d)
+	if cerr := d.DB.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readPassword returns args[i] or reads a line from stdin
+func readPassword(args []string, i int) ([]byte, error) {
+	if len(args) > i {
+		return []byte(args[i]), nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return nil, err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return nil, errors.New("empty password")
+	}
+	return []byte(password), nil
+}
+
+func userAdd(args []string) error {
+	fs := flag.NewFlagSet("user add", flag.ContinueOnError)
+	admin := fs.Bool("admin", false, "give the user admin rights")
+	persona := fs.Int64("persona", 0, "persona ID")
+	display := fs.String("display", "", "display name")
+	if fs.Parse(args) != nil || fs.NArg() < 1 || fs.NArg() > 2 {
+		return errUsage
+	}
+	name := fs.Arg(0)
+	if !xmpp.NodeValid(name) {
+		return fmt.Errorf("invalid user name %q", name)
+	}
+	password, err := readPassword(fs.Args(), 1)
+	if err != nil {
+		return err
+	}
+	return withDB(func(d *db.DB) error {
+		return d.UpdateUser(name, func(u *db.User) error {
+			if len(u.Keys.StoredKey) != 0 {
+				return fmt.Errorf("user %v already exists", name)
+			}
+			u.Password = password
+			u.PersonaID = *persona
+			u.DisplayName = *display
+			u.Flags.Set(db.UserAdmin, *admin)
+			return nil
+		})
+	})
+}
+
+func userDel(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return withDB(func(d *db.DB) error {
+		user, err := d.GetUser(args[0])
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("user %v does not exist", args[0])
+		}
+		return d.DeleteUser(args[0])
+	})
+}
+
+func userList(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return withDB(func(d *db.DB) error {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tPERSONA\tCREATED\tLAST LOGIN\tFLAGS")
+		err := d.ForEachUser(func(u *db.User) error {
+			var flags []string
+			for _, f := range []struct {
+				flag db.UserFlags
+				name string
+			}{{db.UserAdmin, "admin"}, {db.UserBanned, "banned"}, {db.UserMuted, "muted"}} {
+				if u.Flags.Has(f.flag) {
+					flags = append(flags, f.name)
+				}
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", u.Name, u.PersonaID,
+				formatTime(u.CreatedAt), formatTime(u.LastLogin), strings.Join(flags, ","))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return w.Flush()
+	})
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func userPasswd(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	password, err := readPassword(args, 1)
+	if err != nil {
+		return err
+	}
+	return withDB(func(d *db.DB) error {
+		return d.UpdateUser(args[0], func(u *db.User) error {
+			if len(u.Keys.StoredKey) == 0 {
+				return fmt.Errorf("user %v does not exist", args[0])
+			}
+			u.Password = password
+			return nil
+		})
+	})
+}
+
+func dbExport(args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	return withDB(func(d *db.DB) error {
+		export, err := d.Export()
+		if err != nil {
+			return err
+		}
+		out := os.Stdout
+		if len(args) == 1 {
+			out, err = os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(export)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Exported %v users, %v bans, %v mutes\n",
+			len(export.Users), len(export.Bans), len(export.Mutes))
+		if out != os.Stdout {
+			return out.Sync()
+		}
+		return nil
+	})
+}
+
+func dbImport(args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	in := os.Stdin
+	if len(args) == 1 {
+		var err error
+		in, err = os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	var export db.Export
+	err := json.NewDecoder(in).Decode(&export)
+	if err != nil {
+		return fmt.Errorf("invalid export: %v", err)
+	}
+	for _, u := range export.Users {
+		if !xmpp.NodeValid(u.Name) {
+			return fmt.Errorf("invalid user name %q", u.Name)
+		}
+	}
+	return withDB(func(d *db.DB) error {
+		result, err := d.Import(&export)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Imported %v users, %v bans, %v mutes\n",
+			result.Users, result.Bans, result.Mutes)
+		return nil
+	})
+}
+
+func dbCompact(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	path := filepath.Join(*dataDir, "sbrwxmpp.db")
+	tmpPath := path + ".compact"
+	src, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer src.DB.Close()
+	os.Remove(tmpPath)
+	dst, err := bolt.Open(tmpPath, 0600, nil)
+	if err != nil {
+		return err
+	}
+	err = db.Compact(dst, src.DB)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	after, err := os.Stat(tmpPath)
+	if err != nil {
+		return err
+	}
+	// The lock on the old file is held until it is replaced
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Compacted %v bytes to %v bytes\n", before.Size(), after.Size())
+	return nil
+}
+
+func dbCheck(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return withDB(func(d *db.DB) error {
+		users, errs := d.Check()
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%v problems found", len(errs))
+		}
+		fmt.Fprintf(os.Stderr, "OK, %v users\n", users)
+		return nil
+	})
+}
+
+func certGenerate(args []string) error {
+	fs := flag.NewFlagSet("cert generate", flag.ContinueOnError)
+	force := fs.Bool("force", false, "replace an existing certificate")
+	if fs.Parse(args) != nil || fs.NArg() > 1 {
+		return errUsage
+	}
+	domain := fs.Arg(0)
+	if domain == "" {
+		config, err := pconfig.LoadConfig(*configPath)
+		if err != nil {
+			return fmt.Errorf("no domain given and failed to read config: %v", err)
+		}
+		domain = config.Domain
+	}
+	certDir := filepath.Join(*dataDir, "sbrwxmpp-certs")
+	certPath := filepath.Join(certDir, domain+".crt")
+	if _, err := os.Stat(certPath); err == nil && !*force {
+		return fmt.Errorf("%v already exists, use -force to replace it", certPath)
+	}
+	err := os.MkdirAll(certDir, 0700)
+	if err != nil {
+		return err
+	}
+	err = certgen.GenerateCertificate(certDir, domain)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Generated %v\n", certPath)
+	return nil
+}
@@ -5,17 +5,91 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
 
-func LoadConfig() (*Config, error) {
-	data, err := ioutil.ReadFile("./sbrwxmpp.toml")
+// DefaultPath is where the configuration is read from if no path is given
+const DefaultPath = "sbrwxmpp.toml"
+
+// LoadConfig reads the configuration file at path and applies environment
+// overrides. Unknown keys in the file are reported as an error.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 	config := new(Config)
-	_, err = toml.Decode(string(data), config)
-	return config, err
+	md, err := toml.Decode(string(data), config)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return nil, fmt.Errorf("unknown configuration keys in %v: %v", path, strings.Join(keys, ", "))
+	}
+	err = ApplyEnv(config, os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	return config, validate(config)
+}
+
+// validate checks values the TOML decoder can't
+func validate(c *Config) error {
+	err := checkEnum("log format", c.LogFormat, "text", "json")
+	if err != nil {
+		return err
+	}
+	for name, category := range c.Logging {
+		err = checkEnum("log level of "+name, category.Level, "debug", "info")
+		if err != nil {
+			return err
+		}
+	}
+	err = checkEnum("mute notify", c.Mute.Notify, "chatmsg", "error", "none")
+	if err != nil {
+		return err
+	}
+	err = checkEnum("outbound overflow", c.Outbound.Overflow, "disconnect", "drop-oldest")
+	if err != nil {
+		return err
+	}
+	for _, room := range c.History.Rooms {
+		if _, err := path.Match(room.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid history room pattern %q: %v", room.Pattern, err)
+		}
+	}
+	names := make(map[string]bool)
+	for _, room := range c.Rooms {
+		if room.Name == "" || strings.ContainsAny(room.Name, "\"&'/:<>@") {
+			return fmt.Errorf("invalid room name %q", room.Name)
+		}
+		if names[strings.ToLower(room.Name)] {
+			return fmt.Errorf("duplicate room %q", room.Name)
+		}
+		names[strings.ToLower(room.Name)] = true
+	}
+	return nil
+}
+
+// checkEnum returns an error if value isn't empty or one of valid
+func checkEnum(name, value string, valid ...string) error {
+	if value == "" {
+		return nil
+	}
+	for _, v := range valid {
+		if value == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid %v %q, must be one of %v", name, value, strings.Join(valid, ", "))
 }
@@ -0,0 +1,32 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package config
+
+import "testing"
+
+func TestValidateEnums(t *testing.T) {
+	valid := &Config{
+		LogFormat: "json",
+		Logging:   map[string]LoggingCategory{"auth": {Level: "info"}},
+		Mute:      MuteConfig{Notify: "none"},
+		Outbound:  OutboundConfig{Overflow: "drop-oldest"},
+	}
+	if err := validate(valid); err != nil {
+		t.Fatal(err)
+	}
+	if err := validate(&Config{}); err != nil {
+		t.Fatalf("defaults rejected: %v", err)
+	}
+	for name, c := range map[string]*Config{
+		"log format": {LogFormat: "xml"},
+		"log level":  {Logging: map[string]LoggingCategory{"auth": {Level: "trace"}}},
+		"notify":     {Mute: MuteConfig{Notify: "email"}},
+		"overflow":   {Outbound: OutboundConfig{Overflow: "drop-newest"}},
+	} {
+		if err := validate(c); err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+}
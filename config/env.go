@@ -0,0 +1,159 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of environment variables overriding the
+// configuration. The rest of the name is the TOML key in upper case with
+// dots replaced by underscores, e.g. SBRWXMPP_API_KEY or
+// SBRWXMPP_LOGGING_AUTH_DESTINATION. Arrays like rooms are set as a whole
+// with a JSON value, e.g. SBRWXMPP_ROOMS='[{"name": "channel.en__1"}]'.
+const EnvPrefix = "SBRWXMPP_"
+
+// ApplyEnv overrides configuration fields with environment variables. env
+// is a list of KEY=value strings as returned by os.Environ. Variables with
+// the prefix that don't match a field are reported as an error.
+func ApplyEnv(c *Config, env []string) error {
+	vars := make(map[string]string)
+	for _, kv := range env {
+		i := strings.Index(kv, "=")
+		if i == -1 || !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		vars[kv[:i]] = kv[i+1:]
+	}
+	err := applyEnv(reflect.ValueOf(c).Elem(), strings.TrimSuffix(EnvPrefix, "_"), vars)
+	if err != nil {
+		return err
+	}
+	if len(vars) > 0 {
+		unknown := make([]string, 0, len(vars))
+		for name := range vars {
+			unknown = append(unknown, name)
+		}
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown environment variables: %v", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// applyEnv sets the fields of v and removes the variables it used from vars
+func applyEnv(v reflect.Value, prefix string, vars map[string]string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := prefix + "_" + strings.ToUpper(tomlKey(t.Field(i)))
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.Struct:
+			err := applyEnv(field, name, vars)
+			if err != nil {
+				return err
+			}
+		case reflect.Map:
+			err := applyEnvMap(field, name, vars)
+			if err != nil {
+				return err
+			}
+		case reflect.Slice:
+			value, ok := vars[name]
+			if !ok {
+				continue
+			}
+			delete(vars, name)
+			slice := reflect.New(field.Type())
+			err := json.Unmarshal([]byte(value), slice.Interface())
+			if err != nil {
+				return fmt.Errorf("invalid value for %v: %v", name, err)
+			}
+			field.Set(slice.Elem())
+		default:
+			value, ok := vars[name]
+			if !ok {
+				continue
+			}
+			delete(vars, name)
+			err := setValue(field, value)
+			if err != nil {
+				return fmt.Errorf("invalid value for %v: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// tomlKey returns the key of a field in the configuration file. Like the
+// TOML decoder, it falls back to the field name, which is matched case
+// insensitively.
+func tomlKey(f reflect.StructField) string {
+	if tag := strings.Split(f.Tag.Get("toml"), ",")[0]; tag != "" {
+		return tag
+	}
+	return strings.ToLower(f.Name)
+}
+
+// applyEnvMap handles maps of structs like Logging, where the map key is
+// the part of the variable name after the prefix, e.g.
+// SBRWXMPP_LOGGING_AUTH_LEVEL sets Logging["auth"].Level.
+func applyEnvMap(m reflect.Value, prefix string, vars map[string]string) error {
+	elemType := m.Type().Elem()
+	if m.Type().Key().Kind() != reflect.String || elemType.Kind() != reflect.Struct {
+		return nil
+	}
+	keys := make(map[string]bool)
+	for name := range vars {
+		if !strings.HasPrefix(name, prefix+"_") {
+			continue
+		}
+		rest := strings.TrimPrefix(name, prefix+"_")
+		if i := strings.Index(rest, "_"); i > 0 {
+			keys[strings.ToLower(rest[:i])] = true
+		}
+	}
+	for key := range keys {
+		if m.IsNil() {
+			m.Set(reflect.MakeMap(m.Type()))
+		}
+		elem := reflect.New(elemType).Elem()
+		if existing := m.MapIndex(reflect.ValueOf(key)); existing.IsValid() {
+			elem.Set(existing)
+		}
+		err := applyEnv(elem, prefix+"_"+strings.ToUpper(key), vars)
+		if err != nil {
+			return err
+		}
+		m.SetMapIndex(reflect.ValueOf(key), elem)
+	}
+	return nil
+}
+
+func setValue(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	default:
+		return fmt.Errorf("unsupported type %v", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyEnv(t *testing.T) {
+	c := &Config{
+		Domain:  "localhost",
+		Logging: map[string]LoggingCategory{"auth": {Destination: "auth.log", MaxSize: 10}},
+	}
+	err := ApplyEnv(c, []string{
+		"SBRWXMPP_DOMAIN=example.com",
+		"SBRWXMPP_VERBOSE=true",
+		"SBRWXMPP_API_KEY=secret",
+		"SBRWXMPP_OUTBOUND_QUEUESIZE=64",
+		"SBRWXMPP_LOGGING_AUTH_LEVEL=info",
+		"SBRWXMPP_LOGGING_CHAT_DESTINATION=discard",
+		`SBRWXMPP_ROOMS=[{"name": "channel.en__1", "maxoccupants": 10}]`,
+		`SBRWXMPP_HISTORY_ROOMS=[{"pattern": "group.*", "maxstanzas": 50}]`,
+		"PATH=/bin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Domain != "example.com" || !c.Verbose || c.API.Key != "secret" || c.Outbound.QueueSize != 64 {
+		t.Errorf("overrides not applied: %+v", c)
+	}
+	if auth := c.Logging["auth"]; auth.Level != "info" || auth.Destination != "auth.log" || auth.MaxSize != 10 {
+		t.Errorf("logging.auth = %+v", auth)
+	}
+	if c.Logging["chat"].Destination != "discard" {
+		t.Errorf("logging.chat = %+v", c.Logging["chat"])
+	}
+	if len(c.Rooms) != 1 || c.Rooms[0].Name != "channel.en__1" || c.Rooms[0].MaxOccupants != 10 {
+		t.Errorf("rooms = %+v", c.Rooms)
+	}
+	if len(c.History.Rooms) != 1 || c.History.Rooms[0].MaxStanzas != 50 {
+		t.Errorf("history.rooms = %+v", c.History.Rooms)
+	}
+}
+
+// envVars returns a variable with a non-zero value for every field of t,
+// named after its TOML key. Maps get a single "test" entry.
+func envVars(t reflect.Type, prefix string) []string {
+	var vars []string
+	for i := 0; i < t.NumField(); i++ {
+		name := prefix + "_" + strings.ToUpper(tomlKey(t.Field(i)))
+		switch ft := t.Field(i).Type; ft.Kind() {
+		case reflect.Struct:
+			vars = append(vars, envVars(ft, name)...)
+		case reflect.Map:
+			vars = append(vars, envVars(ft.Elem(), name+"_TEST")...)
+		case reflect.Slice:
+			vars = append(vars, name+"=[{}]")
+		case reflect.Bool:
+			vars = append(vars, name+"=true")
+		case reflect.Int:
+			vars = append(vars, name+"=1")
+		default:
+			vars = append(vars, name+"=x")
+		}
+	}
+	return vars
+}
+
+// zeroFields returns the paths of all fields of v that are still zero
+func zeroFields(v reflect.Value, prefix string) []string {
+	var zero []string
+	for i := 0; i < v.NumField(); i++ {
+		name := prefix + "." + tomlKey(v.Type().Field(i))
+		switch field := v.Field(i); field.Kind() {
+		case reflect.Struct:
+			zero = append(zero, zeroFields(field, name)...)
+		case reflect.Map:
+			elem := field.MapIndex(reflect.ValueOf("test"))
+			if !elem.IsValid() {
+				zero = append(zero, name)
+				continue
+			}
+			zero = append(zero, zeroFields(elem, name+".test")...)
+		default:
+			if reflect.DeepEqual(field.Interface(), reflect.Zero(field.Type()).Interface()) {
+				zero = append(zero, name)
+			}
+		}
+	}
+	return zero
+}
+
+func TestApplyEnvAllFields(t *testing.T) {
+	c := &Config{}
+	err := ApplyEnv(c, envVars(reflect.TypeOf(*c), strings.TrimSuffix(EnvPrefix, "_")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range zeroFields(reflect.ValueOf(*c), "config") {
+		t.Errorf("%v has no environment variable", name)
+	}
+}
+
+func TestApplyEnvInvalid(t *testing.T) {
+	err := ApplyEnv(&Config{}, []string{"SBRWXMPP_VERBOSE=maybe"})
+	if err == nil {
+		t.Error("expected an error for an invalid bool")
+	}
+}
+
+func TestApplyEnvUnknown(t *testing.T) {
+	err := ApplyEnv(&Config{}, []string{"SBRWXMPP_API_KEY=secret", "SBRWXMPP_APIKEY=secret", "SBRWXMPP_LOGGING_AUTH_COLOR=red"})
+	if err == nil || !strings.Contains(err.Error(), "SBRWXMPP_APIKEY, SBRWXMPP_LOGGING_AUTH_COLOR") {
+		t.Errorf("expected an error naming the unknown variables, got %v", err)
+	}
+}
@@ -5,18 +5,35 @@
 package config
 
 type Config struct {
-	Addr    string
-	Cert    string
-	CertKey string
-	Domain  string
-	Verbose bool
-	API     APIConfig
-	Webhook WebhookConfig
-	Logging map[string]LoggingCategory
+	Addr     string
+	Cert     string
+	CertKey  string
+	Domain   string
+	Verbose  bool
+	API      APIConfig
+	Webhook  WebhookConfig
+	Mute     MuteConfig
+	ChatLog  ChatLogConfig
+	Outbound OutboundConfig
+	Shutdown ShutdownConfig
+	History  HistoryConfig
+	// Rooms are created when the server starts and never destroyed
+	Rooms []RoomConfig
+	// LogFormat is "text" (default) or "json"
+	LogFormat string
+	Logging   map[string]LoggingCategory
 }
 
 type LoggingCategory struct {
+	// Destination is "stderr" (default), "discard" or a file path
 	Destination string
+	// Level is "debug" or "info", defaults to debug if Verbose is set
+	Level string
+	// MaxSize in megabytes and MaxAge in days after which log files are
+	// rotated, MaxBackups is the number of rotated files to keep
+	MaxSize    int
+	MaxAge     int
+	MaxBackups int
 }
 
 type APIConfig struct {
@@ -28,3 +45,73 @@ type WebhookConfig struct {
 	Target string
 	Secret string
 }
+
+type MuteConfig struct {
+	// Notify is how muted players are told their message was dropped:
+	// "chatmsg" (default) sends a system chat message, "error" bounces
+	// the message with an error and "none" drops it silently
+	Notify  string
+	Message string
+}
+
+type OutboundConfig struct {
+	// QueueSize is the number of stanzas buffered for every client,
+	// defaults to 1024
+	QueueSize int
+	// Overflow is what happens when a client's queue is full:
+	// "disconnect" (default) closes the stream with a policy-violation
+	// error and "drop-oldest" discards the oldest queued stanza
+	Overflow string
+}
+
+type ShutdownConfig struct {
+	// Message is sent to all players as a system chat message before
+	// the server shuts down, empty disables the announcement
+	Message string
+	// Timeout is how many seconds to wait for clients to disconnect,
+	// defaults to 10
+	Timeout int
+}
+
+type HistoryConfig struct {
+	// MaxStanzas is the number of groupchat messages kept per room and
+	// sent to joining players, defaults to 20. Negative disables history.
+	MaxStanzas int
+	// MaxAge is the number of seconds after which messages are dropped
+	// from history, zero keeps them until newer messages replace them
+	MaxAge int
+	// Rooms override the limits for rooms matching a pattern. The first
+	// matching entry is used.
+	Rooms []RoomHistoryConfig
+}
+
+type RoomHistoryConfig struct {
+	// Pattern is matched against the bare room JID with path.Match,
+	// e.g. "group.*@conference.*"
+	Pattern string
+	// MaxStanzas and MaxAge replace the global limits if not zero
+	MaxStanzas int
+	MaxAge     int
+}
+
+type RoomConfig struct {
+	// Name is the local part of the room JID, e.g. "channel.en__1"
+	Name string
+	// MaxOccupants limits the number of occupants, zero is unlimited
+	MaxOccupants int
+	// MembersOnly rooms can only be joined by members, admins and owners
+	MembersOnly bool
+	// Password is required to join the room if set
+	Password string
+	// Moderated rooms make occupants without an affiliation visitors
+	Moderated bool
+	// HistorySize replaces the history limit if not zero, negative
+	// disables history
+	HistorySize int
+}
+
+type ChatLogConfig struct {
+	// RetentionDays is how long chat messages are kept, zero keeps them
+	// forever
+	RetentionDays int
+}
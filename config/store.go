@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"reflect"
+	"sync/atomic"
+)
+
+// Store holds the running configuration. It is replaced as a whole on
+// reload, so a Config returned by Get is a consistent snapshot and must
+// not be modified.
+type Store struct {
+	v atomic.Value
+}
+
+func NewStore(c *Config) *Store {
+	s := &Store{}
+	s.Set(c)
+	return s
+}
+
+func (s *Store) Get() *Config {
+	return s.v.Load().(*Config)
+}
+
+func (s *Store) Set(c *Config) {
+	s.v.Store(c)
+}
+
+// Reload returns the configuration to run with when next is loaded while
+// cur is running. Fields that only take effect after a restart keep their
+// current value and are returned by their TOML key.
+func Reload(cur, next *Config) (*Config, []string) {
+	c := *next
+	var restart []string
+	if c.Addr != cur.Addr {
+		restart = append(restart, "addr")
+		c.Addr = cur.Addr
+	}
+	if c.Domain != cur.Domain {
+		restart = append(restart, "domain")
+		c.Domain = cur.Domain
+	}
+	if c.API.Addr != cur.API.Addr {
+		restart = append(restart, "api.addr")
+		c.API.Addr = cur.API.Addr
+	}
+	if c.ChatLog.RetentionDays != cur.ChatLog.RetentionDays {
+		restart = append(restart, "chatlog.retentiondays")
+		c.ChatLog.RetentionDays = cur.ChatLog.RetentionDays
+	}
+	if !reflect.DeepEqual(c.Rooms, cur.Rooms) {
+		restart = append(restart, "rooms")
+		c.Rooms = cur.Rooms
+	}
+	return &c, restart
+}
@@ -0,0 +1,43 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	cur := &Config{Addr: ":5222", Domain: "a.example", Webhook: WebhookConfig{Target: "http://old"}}
+	next := &Config{Addr: ":5223", Domain: "a.example", Webhook: WebhookConfig{Target: "http://new"}}
+	c, restart := Reload(cur, next)
+	if !reflect.DeepEqual(restart, []string{"addr"}) {
+		t.Errorf("restart = %v, want [addr]", restart)
+	}
+	if c.Addr != ":5222" {
+		t.Errorf("addr = %v, want the running value", c.Addr)
+	}
+	if c.Webhook.Target != "http://new" {
+		t.Errorf("webhook target = %v, want the reloaded value", c.Webhook.Target)
+	}
+	if next.Addr != ":5223" {
+		t.Error("Reload modified its argument")
+	}
+}
+
+func TestReloadRooms(t *testing.T) {
+	cur := &Config{Rooms: []RoomConfig{{Name: "lobby"}}}
+	next := &Config{Rooms: []RoomConfig{{Name: "lobby", Moderated: true}}}
+	c, restart := Reload(cur, next)
+	if !reflect.DeepEqual(restart, []string{"rooms"}) || c.Rooms[0].Moderated {
+		t.Errorf("restart = %v, rooms = %v", restart, c.Rooms)
+	}
+	if err := validate(&Config{Rooms: []RoomConfig{{Name: "lobby"}, {Name: "Lobby"}}}); err == nil {
+		t.Error("duplicate rooms accepted")
+	}
+	if err := validate(&Config{Rooms: []RoomConfig{{Name: "a@b"}}}); err == nil {
+		t.Error("invalid room name accepted")
+	}
+}
@@ -0,0 +1,198 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type Ban struct {
+	ID uint64 `json:"id"`
+	// User and IP are optional, a ban matches if either of the set
+	// fields matches
+	User      string    `json:"user,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Reason    string    `json:"reason"`
+	IssuedBy  string    `json:"issuedBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	// ExpiresAt is zero for permanent bans
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (b Ban) Expired(now time.Time) bool {
+	return !b.ExpiresAt.IsZero() && !now.Before(b.ExpiresAt)
+}
+
+func (b Ban) Matches(user, ip string) bool {
+	return (b.User != "" && strings.EqualFold(b.User, user)) ||
+		(b.IP != "" && b.IP == ip)
+}
+
+// banIndex holds the stored bans keyed by user and IP address
+type banIndex struct {
+	all    []Ban
+	byUser map[string][]Ban
+	byIP   map[string][]Ban
+}
+
+func newBanIndex(bans []Ban) *banIndex {
+	idx := &banIndex{
+		all:    bans,
+		byUser: make(map[string][]Ban),
+		byIP:   make(map[string][]Ban),
+	}
+	for _, ban := range bans {
+		if ban.User != "" {
+			user := strings.ToLower(ban.User)
+			idx.byUser[user] = append(idx.byUser[user], ban)
+		}
+		if ban.IP != "" {
+			idx.byIP[ban.IP] = append(idx.byIP[ban.IP], ban)
+		}
+	}
+	return idx
+}
+
+// readBans returns all stored bans in ID order, including expired ones
+func readBans(tx *bolt.Tx) ([]Ban, error) {
+	var bans []Ban
+	err := tx.Bucket([]byte("bans")).ForEach(func(k, v []byte) error {
+		var ban Ban
+		err := json.Unmarshal(v, &ban)
+		if err != nil {
+			return err
+		}
+		bans = append(bans, ban)
+		return nil
+	})
+	return bans, err
+}
+
+// bans returns the ban index, or reads the bans if the index isn't set up
+func (d DB) bans() (*banIndex, error) {
+	if d.index != nil {
+		return d.index.bans.Load().(*banIndex), nil
+	}
+	var bans []Ban
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		bans, err = readBans(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newBanIndex(bans), nil
+}
+
+// reloadBans updates the ban index after the bans were changed
+func (d DB) reloadBans() error {
+	if d.index == nil {
+		return nil
+	}
+	d.index.mu.Lock()
+	defer d.index.mu.Unlock()
+	var bans []Ban
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		bans, err = readBans(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	d.index.bans.Store(newBanIndex(bans))
+	return nil
+}
+
+// AddBan stores a new ban and sets its ID
+func (d DB) AddBan(ban *Ban) error {
+	err := d.DB.Update(func(tx *bolt.Tx) error {
+		bans := tx.Bucket([]byte("bans"))
+		id, err := bans.NextSequence()
+		if err != nil {
+			return err
+		}
+		ban.ID = id
+		data, err := json.Marshal(ban)
+		if err != nil {
+			return err
+		}
+		return bans.Put(sequenceKey(id), data)
+	})
+	if err != nil {
+		return err
+	}
+	return d.reloadBans()
+}
+
+// DeleteBan lifts a ban. It returns false if the ban does not exist.
+func (d DB) DeleteBan(id uint64) (bool, error) {
+	found, err := d.deleteSequenceKey("bans", id)
+	if err != nil || !found {
+		return found, err
+	}
+	return true, d.reloadBans()
+}
+
+// GetBans returns all active bans
+func (d DB) GetBans() ([]Ban, error) {
+	idx, err := d.bans()
+	if err != nil {
+		return nil, err
+	}
+	var active []Ban
+	now := time.Now()
+	for _, ban := range idx.all {
+		if !ban.Expired(now) {
+			active = append(active, ban)
+		}
+	}
+	return active, nil
+}
+
+// FindBan returns an active ban matching the user or IP address, or nil
+// if there is none.
+func (d DB) FindBan(user, ip string) (*Ban, error) {
+	idx, err := d.bans()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, bans := range [][]Ban{idx.byUser[strings.ToLower(user)], idx.byIP[ip]} {
+		for _, ban := range bans {
+			if !ban.Expired(now) && ban.Matches(user, ip) {
+				return &ban, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// deleteExpiredBans removes expired bans from the database
+func (d DB) deleteExpiredBans(now time.Time) error {
+	idx, err := d.bans()
+	if err != nil {
+		return err
+	}
+	var expired []uint64
+	for _, ban := range idx.all {
+		if ban.Expired(now) {
+			expired = append(expired, ban.ID)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	err = d.deleteSequenceKeys("bans", expired)
+	if err != nil {
+		return err
+	}
+	return d.reloadBans()
+}
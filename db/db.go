@@ -4,49 +4,439 @@
 
 package db
 
-import bolt "go.etcd.io/bbolt"
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/redbluescreen/sbrwxmpp/scram"
+)
 
 type DB struct {
 	DB *bolt.DB
+	// index caches records that are looked up on every login or message.
+	// It is set up by Initialize, lookups read the database without it.
+	index *index
+}
+
+type index struct {
+	// mu serializes reloads, so that a stale read can't replace a newer one
+	mu    sync.Mutex
+	bans  atomic.Value // *banIndex
+	mutes atomic.Value // *muteIndex
+	// usersMu is held across user writes and the update of muted, so that
+	// muted is updated in commit order
+	usersMu sync.Mutex
+	// muted holds the names of users with the UserMuted flag
+	muted atomic.Value // map[string]bool
+}
+
+func (d *DB) Initialize() error {
+	err := d.DB.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"users", "bans", "mutes", "rooms"} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = d.migrateUsers()
+	if err != nil {
+		return err
+	}
+	d.index = &index{}
+	err = d.loadMuted()
+	if err != nil {
+		return err
+	}
+	err = d.reloadBans()
+	if err != nil {
+		return err
+	}
+	return d.reloadMutes()
+}
+
+// loadMuted reads the names of all muted users into the index
+func (d DB) loadMuted() error {
+	muted := make(map[string]bool)
+	err := d.ForEachUser(func(u *User) error {
+		if u.Flags.Has(UserMuted) {
+			muted[u.Name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.index.muted.Store(muted)
+	return nil
+}
+
+// lockUsers locks the index for a user write and returns the function
+// that unlocks it
+func (d DB) lockUsers() func() {
+	if d.index == nil {
+		return func() {}
+	}
+	d.index.usersMu.Lock()
+	return d.index.usersMu.Unlock
+}
+
+// updateMuted applies the muted flags of written users to the index. It
+// must be called with the lock of lockUsers held.
+func (d DB) updateMuted(changes map[string]bool) {
+	if d.index == nil || len(changes) == 0 {
+		return
+	}
+	old := d.index.muted.Load().(map[string]bool)
+	muted := make(map[string]bool, len(old))
+	for name := range old {
+		muted[name] = true
+	}
+	for name, m := range changes {
+		if m {
+			muted[name] = true
+		} else {
+			delete(muted, name)
+		}
+	}
+	d.index.muted.Store(muted)
 }
 
-func (d DB) Initialize() error {
+// IsUserMuted returns whether the user has the UserMuted flag
+func (d DB) IsUserMuted(name string) (bool, error) {
+	if d.index != nil {
+		return d.index.muted.Load().(map[string]bool)[name], nil
+	}
+	user, err := d.GetUser(name)
+	if err != nil || user == nil {
+		return false, err
+	}
+	return user.Flags.Has(UserMuted), nil
+}
+
+// migrateUsers rewrites user records stored by older versions in the
+// current format. Plaintext passwords get hashed on the way.
+func (d DB) migrateUsers() error {
 	return d.DB.Update(func(tx *bolt.Tx) error {
-		tx.CreateBucketIfNotExists([]byte("users"))
+		users := tx.Bucket([]byte("users"))
+		var outdated [][]byte
+		err := users.ForEach(func(k, v []byte) error {
+			if recordVersion(v) < userRecordCurrent {
+				outdated = append(outdated, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range outdated {
+			user, err := decodeUser(string(name), users.Get(name))
+			if err != nil {
+				return err
+			}
+			data, err := encodeUser(user)
+			if err != nil {
+				return err
+			}
+			err = users.Put(name, data)
+			if err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 }
 
+// GetUser returns the user with the given name, or nil if it does not exist.
 func (d DB) GetUser(name string) (*User, error) {
-	result := &User{
-		Name: name,
-	}
+	var result *User
 	err := d.DB.View(func(tx *bolt.Tx) error {
 		users := tx.Bucket([]byte("users"))
-		password := users.Get([]byte(name))
-		if password == nil {
+		data := users.Get([]byte(name))
+		if data == nil {
 			return nil
 		}
-		// bolt byte slices are invalid outside of transaction, copying
-		result.Password = make([]byte, len(password))
-		copy(result.Password, password)
-		return nil
+		var err error
+		result, err = decodeUser(name, data)
+		return err
 	})
 	return result, err
 }
 
+// ListUsers returns up to limit users whose names start with prefix, in
+// name order starting after the name after. more is true if there are
+// further matching users.
+func (d DB) ListUsers(prefix, after string, limit int) (result []*User, more bool, err error) {
+	err = d.DB.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("users")).Cursor()
+		start := prefix
+		if after > start {
+			start = after
+		}
+		for k, v := c.Seek([]byte(start)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if string(k) == after {
+				continue
+			}
+			if len(result) == limit {
+				more = true
+				return nil
+			}
+			user, err := decodeUser(string(k), v)
+			if err != nil {
+				return err
+			}
+			result = append(result, user)
+		}
+		return nil
+	})
+	return result, more, err
+}
+
+// UpsertUser stores a user, replacing an existing one. If user.Password is
+// set, new keys are derived from it, otherwise the stored keys are kept
+// unless user.Keys is set.
 func (d DB) UpsertUser(user User) error {
-	return d.DB.Update(func(tx *bolt.Tx) error {
+	return d.UpdateUser(user.Name, func(u *User) error {
+		createdAt, keys := u.CreatedAt, u.Keys
+		*u = user
+		if u.CreatedAt.IsZero() {
+			u.CreatedAt = createdAt
+		}
+		if u.Password == nil && len(u.Keys.StoredKey) == 0 {
+			u.Keys = keys
+		}
+		return nil
+	})
+}
+
+// UpdateUser calls fn with the stored user, or a new user if it doesn't
+// exist yet, and stores the result in the same transaction. If the
+// Password of the user is set after fn, new keys are derived from it.
+// fn is called once more before the transaction, so it must not have
+// side effects.
+func (d DB) UpdateUser(name string, fn func(u *User) error) error {
+	keys, err := d.deriveKeys(name, fn)
+	if err != nil {
+		return err
+	}
+	defer d.lockUsers()()
+	var user *User
+	err = d.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		user, err = updateUser(tx.Bucket([]byte("users")), name, fn, keys)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	d.updateMuted(map[string]bool{name: user.Flags.Has(UserMuted)})
+	return nil
+}
+
+// passwordKeys holds keys derived ahead of a transaction
+type passwordKeys struct {
+	password []byte
+	keys     scram.Keys
+}
+
+// deriveKeys applies fn to a copy of the stored user and derives the
+// keys of the password it sets, if any. Deriving them is slow, so it is
+// done before the write transaction instead of blocking other writers.
+func (d DB) deriveKeys(name string, fn func(u *User) error) (*passwordKeys, error) {
+	user, err := d.GetUser(name)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		user = &User{Name: name}
+	}
+	if fn(user) != nil || user.Password == nil {
+		// The error is returned by the actual update
+		return nil, nil
+	}
+	keys, err := NewKeys(user.Password)
+	if err != nil {
+		return nil, err
+	}
+	return &passwordKeys{password: user.Password, keys: keys}, nil
+}
+
+// updateUser applies fn to a user in users and returns the stored user.
+// If fn sets the password of keys, those are stored instead of deriving
+// new ones.
+func updateUser(users *bolt.Bucket, name string, fn func(u *User) error, keys *passwordKeys) (*User, error) {
+	user := &User{
+		Name:      name,
+		CreatedAt: time.Now(),
+	}
+	if data := users.Get([]byte(name)); data != nil {
+		var err error
+		user, err = decodeUser(name, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := fn(user)
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil && bytes.Equal(user.Password, keys.password) {
+		user.Keys = keys.keys
+	} else if user.Password != nil {
+		err = user.SetPassword(user.Password)
+		if err != nil {
+			return nil, err
+		}
+	}
+	user.Password = nil
+	data, err := encodeUser(user)
+	if err != nil {
+		return nil, err
+	}
+	return user, users.Put([]byte(name), data)
+}
+
+// UserWrite is a single change applied by WriteUsers
+type UserWrite struct {
+	Name string
+	// Delete removes the user, otherwise Update is applied like in
+	// UpdateUser
+	Delete bool
+	Update func(u *User) error
+	// Keys replace the stored keys if set. Unlike Password they are
+	// derived before the transaction, see NewKeys.
+	Keys *scram.Keys
+}
+
+// WriteUsers applies writes in a single transaction and returns the
+// error of every write. A failed write doesn't affect the others.
+func (d DB) WriteUsers(writes []UserWrite) ([]error, error) {
+	errs := make([]error, len(writes))
+	var muted map[string]bool
+	defer d.lockUsers()()
+	err := d.DB.Update(func(tx *bolt.Tx) error {
 		users := tx.Bucket([]byte("users"))
-		users.Put([]byte(user.Name), []byte(user.Password))
+		muted = make(map[string]bool)
+		for i, w := range writes {
+			if w.Delete {
+				errs[i] = users.Delete([]byte(w.Name))
+				if errs[i] == nil {
+					muted[w.Name] = false
+				}
+				continue
+			}
+			update := w.Update
+			if keys := w.Keys; keys != nil {
+				update = func(u *User) error {
+					if w.Update != nil {
+						err := w.Update(u)
+						if err != nil {
+							return err
+						}
+					}
+					u.Keys = *keys
+					return nil
+				}
+			}
+			var user *User
+			user, errs[i] = updateUser(users, w.Name, update, nil)
+			if errs[i] == nil {
+				muted[w.Name] = user.Flags.Has(UserMuted)
+			}
+		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	d.updateMuted(muted)
+	return errs, nil
 }
 
-func (d DB) DeleteUser(name string) error {
+// RecordLogin stores the time and address of a successful login
+func (d DB) RecordLogin(name string, ip string) error {
 	return d.DB.Update(func(tx *bolt.Tx) error {
 		users := tx.Bucket([]byte("users"))
-		users.Delete([]byte(name))
+		data := users.Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		user, err := decodeUser(name, data)
+		if err != nil {
+			return err
+		}
+		user.LastLogin = time.Now()
+		user.LastIP = ip
+		data, err = encodeUser(user)
+		if err != nil {
+			return err
+		}
+		return users.Put([]byte(name), data)
+	})
+}
+
+func (d DB) DeleteUser(name string) error {
+	defer d.lockUsers()()
+	err := d.DB.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket([]byte("users"))
+		return users.Delete([]byte(name))
+	})
+	if err != nil {
+		return err
+	}
+	d.updateMuted(map[string]bool{name: false})
+	return nil
+}
+
+// sequenceKey is the key of records identified by a bucket sequence number
+func sequenceKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// DeleteExpired removes expired bans and mutes from the database.
+// Lookups ignore them already, so it only needs to run from time to time.
+func (d DB) DeleteExpired() error {
+	now := time.Now()
+	err := d.deleteExpiredBans(now)
+	if err != nil {
+		return err
+	}
+	return d.deleteExpiredMutes(now)
+}
+
+func (d DB) deleteSequenceKey(bucket string, id uint64) (bool, error) {
+	found := false
+	err := d.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		found = b.Get(sequenceKey(id)) != nil
+		return b.Delete(sequenceKey(id))
+	})
+	return found, err
+}
+
+func (d DB) deleteSequenceKeys(bucket string, ids []uint64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return d.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		for _, id := range ids {
+			err := b.Delete(sequenceKey(id))
+			if err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 }
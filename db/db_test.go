@@ -0,0 +1,295 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestDB(t *testing.T) (*DB, func()) {
+	dir, err := ioutil.TempDir("", "sbrwxmpp-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bdb, err := bolt.Open(path.Join(dir, "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DB{DB: bdb}, func() {
+		bdb.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMigratePlaintextPasswords(t *testing.T) {
+	d, cleanup := openTestDB(t)
+	defer cleanup()
+	err := d.DB.Update(func(tx *bolt.Tx) error {
+		users, err := tx.CreateBucketIfNotExists([]byte("users"))
+		if err != nil {
+			return err
+		}
+		return users.Put([]byte("sbrw.1"), []byte("hunter2"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.DB.View(func(tx *bolt.Tx) error {
+		if recordVersion(tx.Bucket([]byte("users")).Get([]byte("sbrw.1"))) != userRecordCurrent {
+			t.Fatal("password was not migrated")
+		}
+		return nil
+	})
+	user, err := d.GetUser("sbrw.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.CheckPassword([]byte("hunter2")) {
+		t.Fatal("migrated password rejected")
+	}
+	if user.CheckPassword([]byte("hunter3")) {
+		t.Fatal("wrong password accepted")
+	}
+}
+
+func TestGetMissingUser(t *testing.T) {
+	d, cleanup := openTestDB(t)
+	defer cleanup()
+	err := d.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := d.GetUser("nobody")
+	if err != nil || user != nil {
+		t.Fatalf("expected no user, got %v, %v", user, err)
+	}
+}
+
+func TestDecodeV1Record(t *testing.T) {
+	data := append([]byte{recordMarker, userRecordV1},
+		`{"salt":"AAAA","iterations":4096,"storedKey":"AQID","serverKey":"BAUG"}`...)
+	user, err := decodeUser("sbrw.2", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Keys.Iterations != 4096 || len(user.Keys.StoredKey) != 3 || !user.CreatedAt.IsZero() {
+		t.Fatalf("unexpected user %#v", user)
+	}
+}
+
+func TestExpiredBansRemoved(t *testing.T) {
+	d, cleanup := openTestDB(t)
+	defer cleanup()
+	err := d.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.AddBan(&Ban{User: "sbrw.1", ExpiresAt: time.Now().Add(-time.Minute)})
+	d.AddBan(&Ban{IP: "127.0.0.1", ExpiresAt: time.Now().Add(time.Hour)})
+	ban, err := d.FindBan("sbrw.1", "10.0.0.1")
+	if err != nil || ban != nil {
+		t.Fatalf("expected no ban, got %v, %v", ban, err)
+	}
+	ban, err = d.FindBan("sbrw.1", "127.0.0.1")
+	if err != nil || ban == nil || ban.ID != 2 {
+		t.Fatalf("expected IP ban, got %v, %v", ban, err)
+	}
+	err = d.DeleteExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.DB.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("bans")).Stats().KeyN != 1 {
+			t.Fatal("expired ban was not removed")
+		}
+		return nil
+	})
+}
+
+func TestMuteIndex(t *testing.T) {
+	d, cleanup := openTestDB(t)
+	defer cleanup()
+	if err := d.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	mute := &Mute{User: "sbrw.1", Room: "lobby@conference.localhost"}
+	if err := d.AddMute(mute); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := d.FindMute("SBRW.1", "lobby@conference.localhost"); err != nil || m == nil {
+		t.Fatalf("expected mute, got %v, %v", m, err)
+	}
+	if m, err := d.FindMute("sbrw.1", "other@conference.localhost"); err != nil || m != nil {
+		t.Fatalf("expected no mute in other room, got %v, %v", m, err)
+	}
+	if _, err := d.DeleteMute(mute.ID); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := d.FindMute("sbrw.1", "lobby@conference.localhost"); err != nil || m != nil {
+		t.Fatalf("expected deleted mute to be gone, got %v, %v", m, err)
+	}
+
+	err := d.UpdateUser("sbrw.2", func(u *User) error {
+		u.Flags.Set(UserMuted, true)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if muted, err := d.IsUserMuted("sbrw.2"); err != nil || !muted {
+		t.Fatalf("expected muted flag, got %v, %v", muted, err)
+	}
+	_, err = d.WriteUsers([]UserWrite{{Name: "sbrw.2", Delete: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if muted, err := d.IsUserMuted("sbrw.2"); err != nil || muted {
+		t.Fatalf("expected deleted user to be unmuted, got %v, %v", muted, err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src, cleanup := openTestDB(t)
+	defer cleanup()
+	dst, cleanup2 := openTestDB(t)
+	defer cleanup2()
+	if err := src.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	src.UpsertUser(User{Name: "sbrw.1", Password: []byte("hunter2"), PersonaID: 100, Flags: UserAdmin})
+	src.AddMute(&Mute{User: "sbrw.1", Reason: "spam"})
+	export, err := src.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := dst.Import(export)
+	if err != nil || result.Users != 1 || result.Mutes != 1 {
+		t.Fatalf("unexpected import result %v, %v", result, err)
+	}
+	user, err := dst.GetUser("sbrw.1")
+	if err != nil || user == nil {
+		t.Fatalf("expected user, got %v, %v", user, err)
+	}
+	if !user.CheckPassword([]byte("hunter2")) || user.PersonaID != 100 || !user.Flags.Has(UserAdmin) {
+		t.Fatalf("unexpected user %#v", user)
+	}
+	export.Version = ExportVersion + 1
+	if _, err := dst.Import(export); err == nil {
+		t.Fatal("expected error for unknown version")
+	}
+}
+
+func TestWriteUsers(t *testing.T) {
+	d, cleanup := openTestDB(t)
+	defer cleanup()
+	if err := d.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	d.UpsertUser(User{Name: "sbrw.1", Password: []byte("hunter2")})
+	keys, err := NewKeys([]byte("hunter3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, err := d.WriteUsers([]UserWrite{
+		{Name: "sbrw.1", Delete: true},
+		{Name: "sbrw.2", Update: func(u *User) error { return errors.New("failed") }},
+		{Name: "sbrw.3", Update: func(u *User) error { u.PersonaID = 3; return nil }, Keys: &keys},
+	})
+	if err != nil || errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Fatalf("unexpected errors %v, %v", errs, err)
+	}
+	for name, exists := range map[string]bool{"sbrw.1": false, "sbrw.2": false, "sbrw.3": true} {
+		user, err := d.GetUser(name)
+		if err != nil || (user != nil) != exists {
+			t.Errorf("%v: got %v, %v", name, user, err)
+		}
+	}
+	user, err := d.GetUser("sbrw.3")
+	if err != nil || user.PersonaID != 3 || !user.CheckPassword([]byte("hunter3")) {
+		t.Errorf("keys not stored: %v, %v", user, err)
+	}
+}
+
+func TestUpsertUserKeepsKeys(t *testing.T) {
+	d, cleanup := openTestDB(t)
+	defer cleanup()
+	if err := d.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	d.UpsertUser(User{Name: "sbrw.1", Password: []byte("hunter2")})
+	if err := d.UpsertUser(User{Name: "sbrw.1", PersonaID: 100}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := d.GetUser("sbrw.1")
+	if err != nil || user.PersonaID != 100 || !user.CheckPassword([]byte("hunter2")) {
+		t.Fatalf("keys not kept: %v, %v", user, err)
+	}
+	err = d.UpdateUser("sbrw.1", func(u *User) error {
+		u.Password = []byte("hunter3")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = d.GetUser("sbrw.1")
+	if err != nil || user.Password != nil || !user.CheckPassword([]byte("hunter3")) {
+		t.Fatalf("password not changed: %v, %v", user, err)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	d, cleanup := openTestDB(t)
+	defer cleanup()
+	if err := d.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"admin", "sbrw.1", "sbrw.2", "sbrw.3", "zed"} {
+		d.UpsertUser(User{Name: name})
+	}
+	users, more, err := d.ListUsers("sbrw.", "", 2)
+	if err != nil || len(users) != 2 || !more || users[1].Name != "sbrw.2" {
+		t.Fatalf("unexpected first page %v, %v, %v", users, more, err)
+	}
+	users, more, err = d.ListUsers("sbrw.", users[1].Name, 2)
+	if err != nil || len(users) != 1 || more || users[0].Name != "sbrw.3" {
+		t.Fatalf("unexpected second page %v, %v, %v", users, more, err)
+	}
+}
+
+func TestUpdateRoom(t *testing.T) {
+	d, cleanup := openTestDB(t)
+	defer cleanup()
+	if err := d.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	err := d.UpdateRoom("Channel.EN__1@conference.localhost", func(r *Room) error {
+		r.Subject = "Welcome"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, err := d.GetRoom("channel.en__1@conference.localhost")
+	if err != nil || room == nil || room.Subject != "Welcome" {
+		t.Fatalf("unexpected room %v, %v", room, err)
+	}
+	if found, err := d.DeleteRoom(room.JID); !found || err != nil {
+		t.Fatalf("DeleteRoom = %v, %v", found, err)
+	}
+}
@@ -0,0 +1,198 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ExportVersion is the version of the export format written by Export
+const ExportVersion = 1
+
+// Export holds the accounts, bans and mutes of a server in a format that
+// doesn't depend on how they are stored.
+type Export struct {
+	Version    int          `json:"version"`
+	ExportedAt time.Time    `json:"exportedAt"`
+	Users      []ExportUser `json:"users"`
+	Bans       []Ban        `json:"bans"`
+	Mutes      []Mute       `json:"mutes"`
+}
+
+// ExportUser is a user with its SCRAM keys. Plaintext passwords are
+// never exported.
+type ExportUser struct {
+	Name        string    `json:"name"`
+	Salt        []byte    `json:"salt"`
+	Iterations  int       `json:"iterations"`
+	StoredKey   []byte    `json:"storedKey"`
+	ServerKey   []byte    `json:"serverKey"`
+	CreatedAt   time.Time `json:"createdAt"`
+	LastLogin   time.Time `json:"lastLogin"`
+	LastIP      string    `json:"lastIp,omitempty"`
+	PersonaID   int64     `json:"personaId,omitempty"`
+	DisplayName string    `json:"displayName,omitempty"`
+	Banned      bool      `json:"banned,omitempty"`
+	Muted       bool      `json:"muted,omitempty"`
+	Admin       bool      `json:"admin,omitempty"`
+}
+
+func exportUser(u *User) ExportUser {
+	return ExportUser{
+		Name:        u.Name,
+		Salt:        u.Keys.Salt,
+		Iterations:  u.Keys.Iterations,
+		StoredKey:   u.Keys.StoredKey,
+		ServerKey:   u.Keys.ServerKey,
+		CreatedAt:   u.CreatedAt,
+		LastLogin:   u.LastLogin,
+		LastIP:      u.LastIP,
+		PersonaID:   u.PersonaID,
+		DisplayName: u.DisplayName,
+		Banned:      u.Flags.Has(UserBanned),
+		Muted:       u.Flags.Has(UserMuted),
+		Admin:       u.Flags.Has(UserAdmin),
+	}
+}
+
+func (e ExportUser) user() *User {
+	u := &User{
+		Name:        e.Name,
+		Keys:        userCredentials{e.Salt, e.Iterations, e.StoredKey, e.ServerKey}.keys(),
+		CreatedAt:   e.CreatedAt,
+		LastLogin:   e.LastLogin,
+		LastIP:      e.LastIP,
+		PersonaID:   e.PersonaID,
+		DisplayName: e.DisplayName,
+	}
+	u.Flags.Set(UserBanned, e.Banned)
+	u.Flags.Set(UserMuted, e.Muted)
+	u.Flags.Set(UserAdmin, e.Admin)
+	return u
+}
+
+// ForEachUser calls fn for every stored user in name order
+func (d DB) ForEachUser(fn func(u *User) error) error {
+	return d.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("users")).ForEach(func(k, v []byte) error {
+			user, err := decodeUser(string(k), v)
+			if err != nil {
+				return fmt.Errorf("user %v: %v", string(k), err)
+			}
+			return fn(user)
+		})
+	})
+}
+
+// Export returns all users and active bans and mutes
+func (d DB) Export() (*Export, error) {
+	e := &Export{
+		Version:    ExportVersion,
+		ExportedAt: time.Now().UTC(),
+		Users:      []ExportUser{},
+	}
+	err := d.ForEachUser(func(u *User) error {
+		e.Users = append(e.Users, exportUser(u))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	e.Bans, err = d.GetBans()
+	if err != nil {
+		return nil, err
+	}
+	e.Mutes, err = d.GetMutes()
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ImportResult counts the records written by Import
+type ImportResult struct {
+	Users int `json:"users"`
+	Bans  int `json:"bans"`
+	Mutes int `json:"mutes"`
+}
+
+// Import stores the contents of an export in a single transaction. Users
+// with the same name are replaced, bans and mutes get new IDs.
+func (d DB) Import(e *Export) (ImportResult, error) {
+	var result ImportResult
+	muted := make(map[string]bool)
+	if e.Version < 1 || e.Version > ExportVersion {
+		return result, fmt.Errorf("unsupported export version %v", e.Version)
+	}
+	unlock := d.lockUsers()
+	err := d.DB.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket([]byte("users"))
+		for _, eu := range e.Users {
+			if eu.Name == "" {
+				return fmt.Errorf("user without name")
+			}
+			data, err := encodeUser(eu.user())
+			if err != nil {
+				return err
+			}
+			err = users.Put([]byte(eu.Name), data)
+			if err != nil {
+				return err
+			}
+			muted[eu.Name] = eu.Muted
+			result.Users++
+		}
+		bans := tx.Bucket([]byte("bans"))
+		for _, ban := range e.Bans {
+			id, err := bans.NextSequence()
+			if err != nil {
+				return err
+			}
+			ban.ID = id
+			data, err := json.Marshal(ban)
+			if err != nil {
+				return err
+			}
+			err = bans.Put(sequenceKey(id), data)
+			if err != nil {
+				return err
+			}
+			result.Bans++
+		}
+		mutes := tx.Bucket([]byte("mutes"))
+		for _, mute := range e.Mutes {
+			id, err := mutes.NextSequence()
+			if err != nil {
+				return err
+			}
+			mute.ID = id
+			data, err := json.Marshal(mute)
+			if err != nil {
+				return err
+			}
+			err = mutes.Put(sequenceKey(id), data)
+			if err != nil {
+				return err
+			}
+			result.Mutes++
+		}
+		return nil
+	})
+	if err != nil {
+		unlock()
+		return ImportResult{}, err
+	}
+	d.updateMuted(muted)
+	unlock()
+	err = d.reloadBans()
+	if err != nil {
+		return result, err
+	}
+	return result, d.reloadMutes()
+}
@@ -0,0 +1,122 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// compactTxSize is the number of bytes copied per transaction by Compact
+const compactTxSize = 16 << 20
+
+// Compact copies all buckets of src to the empty database dst, leaving
+// out the free pages of src.
+func Compact(dst, src *bolt.DB) error {
+	tx, err := dst.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	size := 0
+	// commit starts a new transaction when enough data was written
+	commit := func(n int) error {
+		size += n
+		if size < compactTxSize {
+			return nil
+		}
+		size = 0
+		err := tx.Commit()
+		if err != nil {
+			tx = nil
+			return err
+		}
+		tx, err = dst.Begin(true)
+		return err
+	}
+	err = src.View(func(stx *bolt.Tx) error {
+		return stx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return compactBucket(&tx, [][]byte{name}, b, commit)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	tx = nil
+	return err
+}
+
+// compactBucket copies b to the bucket at path in *tx, which commit may
+// replace
+func compactBucket(tx **bolt.Tx, path [][]byte, b *bolt.Bucket, commit func(int) error) error {
+	dst, err := createBucketPath(*tx, path)
+	if err != nil {
+		return err
+	}
+	dst.FillPercent = 1
+	err = dst.SetSequence(b.Sequence())
+	if err != nil {
+		return err
+	}
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return compactBucket(tx, append(path[:len(path):len(path)], k), b.Bucket(k), commit)
+		}
+		dst, err := createBucketPath(*tx, path)
+		if err != nil {
+			return err
+		}
+		dst.FillPercent = 1
+		err = dst.Put(k, v)
+		if err != nil {
+			return err
+		}
+		return commit(len(k) + len(v))
+	})
+}
+
+func createBucketPath(tx *bolt.Tx, path [][]byte) (*bolt.Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists(path[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range path[1:] {
+		b, err = b.CreateBucketIfNotExists(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Check verifies the consistency of the database file and that every
+// user record can be decoded. It returns the number of users and all
+// problems found.
+func (d DB) Check() (int, []error) {
+	var errs []error
+	users := 0
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			errs = append(errs, err)
+		}
+		return tx.Bucket([]byte("users")).ForEach(func(k, v []byte) error {
+			users++
+			if _, err := decodeUser(string(k), v); err != nil {
+				errs = append(errs, fmt.Errorf("user %v: %v", string(k), err))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return users, errs
+}
@@ -4,7 +4,77 @@
 
 package db
 
+import (
+	"crypto/subtle"
+	"time"
+
+	"github.com/redbluescreen/sbrwxmpp/scram"
+)
+
+type UserFlags uint32
+
+const (
+	UserBanned UserFlags = 1 << iota
+	UserMuted
+	UserAdmin
+)
+
+func (f UserFlags) Has(flag UserFlags) bool {
+	return f&flag != 0
+}
+
+// Set sets or clears flag
+func (f *UserFlags) Set(flag UserFlags, value bool) {
+	if value {
+		*f |= flag
+	} else {
+		*f &^= flag
+	}
+}
+
 type User struct {
-	Name     string
+	Name string
+	// Password is the plaintext password to set when upserting. It is
+	// never returned from the database.
 	Password []byte
+	// Keys are the salted SCRAM-SHA-1 keys of the password
+	Keys scram.Keys
+	// CreatedAt is zero for users created before it was recorded
+	CreatedAt   time.Time
+	LastLogin   time.Time
+	LastIP      string
+	PersonaID   int64
+	DisplayName string
+	Flags       UserFlags
+}
+
+// SetPassword replaces the stored keys with ones derived from password
+// using a new salt.
+func (u *User) SetPassword(password []byte) error {
+	keys, err := NewKeys(password)
+	if err != nil {
+		return err
+	}
+	u.Keys = keys
+	return nil
+}
+
+// NewKeys derives the SCRAM keys of password using a new salt. It is
+// slow on purpose, so callers writing many users derive the keys before
+// opening a transaction.
+func NewKeys(password []byte) (scram.Keys, error) {
+	salt, err := scram.NewSalt()
+	if err != nil {
+		return scram.Keys{}, err
+	}
+	return scram.DeriveKeys(password, salt, scram.DefaultIterations), nil
+}
+
+// CheckPassword compares password against the stored keys in constant time.
+func (u *User) CheckPassword(password []byte) bool {
+	if len(u.Keys.StoredKey) == 0 {
+		return false
+	}
+	keys := scram.DeriveKeys(password, u.Keys.Salt, u.Keys.Iterations)
+	return subtle.ConstantTimeCompare(keys.StoredKey, u.Keys.StoredKey) == 1
 }
@@ -0,0 +1,192 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type Mute struct {
+	ID   uint64 `json:"id"`
+	User string `json:"user"`
+	// Room is the bare room JID the mute applies to, empty for all
+	// messages
+	Room      string    `json:"room,omitempty"`
+	Reason    string    `json:"reason"`
+	IssuedBy  string    `json:"issuedBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	// ExpiresAt is zero for permanent mutes
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (m Mute) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
+// Matches returns whether the mute applies to a message from user to the
+// bare JID to.
+func (m Mute) Matches(user, to string) bool {
+	return strings.EqualFold(m.User, user) &&
+		(m.Room == "" || strings.EqualFold(m.Room, to))
+}
+
+// muteIndex holds the stored mutes keyed by user
+type muteIndex struct {
+	all    []Mute
+	byUser map[string][]Mute
+}
+
+func newMuteIndex(mutes []Mute) *muteIndex {
+	idx := &muteIndex{
+		all:    mutes,
+		byUser: make(map[string][]Mute),
+	}
+	for _, mute := range mutes {
+		user := strings.ToLower(mute.User)
+		idx.byUser[user] = append(idx.byUser[user], mute)
+	}
+	return idx
+}
+
+// readMutes returns all stored mutes in ID order, including expired ones
+func readMutes(tx *bolt.Tx) ([]Mute, error) {
+	var mutes []Mute
+	err := tx.Bucket([]byte("mutes")).ForEach(func(k, v []byte) error {
+		var mute Mute
+		err := json.Unmarshal(v, &mute)
+		if err != nil {
+			return err
+		}
+		mutes = append(mutes, mute)
+		return nil
+	})
+	return mutes, err
+}
+
+// mutes returns the mute index, or reads the mutes if the index isn't set
+// up
+func (d DB) mutes() (*muteIndex, error) {
+	if d.index != nil {
+		return d.index.mutes.Load().(*muteIndex), nil
+	}
+	var mutes []Mute
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		mutes, err = readMutes(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newMuteIndex(mutes), nil
+}
+
+// reloadMutes updates the mute index after the mutes were changed
+func (d DB) reloadMutes() error {
+	if d.index == nil {
+		return nil
+	}
+	d.index.mu.Lock()
+	defer d.index.mu.Unlock()
+	var mutes []Mute
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		mutes, err = readMutes(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	d.index.mutes.Store(newMuteIndex(mutes))
+	return nil
+}
+
+// AddMute stores a new mute and sets its ID
+func (d DB) AddMute(mute *Mute) error {
+	err := d.DB.Update(func(tx *bolt.Tx) error {
+		mutes := tx.Bucket([]byte("mutes"))
+		id, err := mutes.NextSequence()
+		if err != nil {
+			return err
+		}
+		mute.ID = id
+		data, err := json.Marshal(mute)
+		if err != nil {
+			return err
+		}
+		return mutes.Put(sequenceKey(id), data)
+	})
+	if err != nil {
+		return err
+	}
+	return d.reloadMutes()
+}
+
+// DeleteMute lifts a mute. It returns false if the mute does not exist.
+func (d DB) DeleteMute(id uint64) (bool, error) {
+	found, err := d.deleteSequenceKey("mutes", id)
+	if err != nil || !found {
+		return found, err
+	}
+	return true, d.reloadMutes()
+}
+
+// GetMutes returns all active mutes
+func (d DB) GetMutes() ([]Mute, error) {
+	idx, err := d.mutes()
+	if err != nil {
+		return nil, err
+	}
+	var active []Mute
+	now := time.Now()
+	for _, mute := range idx.all {
+		if !mute.Expired(now) {
+			active = append(active, mute)
+		}
+	}
+	return active, nil
+}
+
+// FindMute returns an active mute for a message from user to the bare JID
+// to, or nil if there is none.
+func (d DB) FindMute(user, to string) (*Mute, error) {
+	idx, err := d.mutes()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, mute := range idx.byUser[strings.ToLower(user)] {
+		if !mute.Expired(now) && mute.Matches(user, to) {
+			return &mute, nil
+		}
+	}
+	return nil, nil
+}
+
+// deleteExpiredMutes removes expired mutes from the database
+func (d DB) deleteExpiredMutes(now time.Time) error {
+	idx, err := d.mutes()
+	if err != nil {
+		return err
+	}
+	var expired []uint64
+	for _, mute := range idx.all {
+		if mute.Expired(now) {
+			expired = append(expired, mute.ID)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	err = d.deleteSequenceKeys("mutes", expired)
+	if err != nil {
+		return err
+	}
+	return d.reloadMutes()
+}
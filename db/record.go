@@ -0,0 +1,114 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redbluescreen/sbrwxmpp/scram"
+)
+
+// Records in the users bucket start with a zero byte followed by the
+// record version. Values without the marker are plaintext passwords
+// written by older versions.
+const recordMarker = 0x00
+
+const (
+	userRecordLegacy = 0
+	userRecordV1     = 1
+	userRecordV2     = 2
+
+	userRecordCurrent = userRecordV2
+)
+
+// userCredentials is the body of a v1 record
+type userCredentials struct {
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+	StoredKey  []byte `json:"storedKey"`
+	ServerKey  []byte `json:"serverKey"`
+}
+
+type userRecord struct {
+	Credentials userCredentials `json:"credentials"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	LastLogin   time.Time       `json:"lastLogin"`
+	LastIP      string          `json:"lastIp,omitempty"`
+	PersonaID   int64           `json:"personaId,omitempty"`
+	DisplayName string          `json:"displayName,omitempty"`
+	Flags       UserFlags       `json:"flags,omitempty"`
+}
+
+func recordVersion(data []byte) int {
+	if len(data) < 2 || data[0] != recordMarker {
+		return userRecordLegacy
+	}
+	return int(data[1])
+}
+
+func encodeUser(user *User) ([]byte, error) {
+	body, err := json.Marshal(userRecord{
+		Credentials: userCredentials{
+			Salt:       user.Keys.Salt,
+			Iterations: user.Keys.Iterations,
+			StoredKey:  user.Keys.StoredKey,
+			ServerKey:  user.Keys.ServerKey,
+		},
+		CreatedAt:   user.CreatedAt,
+		LastLogin:   user.LastLogin,
+		LastIP:      user.LastIP,
+		PersonaID:   user.PersonaID,
+		DisplayName: user.DisplayName,
+		Flags:       user.Flags,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{recordMarker, userRecordCurrent}, body...), nil
+}
+
+func decodeUser(name string, data []byte) (*User, error) {
+	user := &User{Name: name}
+	switch recordVersion(data) {
+	case userRecordLegacy:
+		err := user.SetPassword(data)
+		return user, err
+	case userRecordV1:
+		var creds userCredentials
+		err := json.Unmarshal(data[2:], &creds)
+		if err != nil {
+			return nil, err
+		}
+		user.Keys = creds.keys()
+		return user, nil
+	case userRecordV2:
+		var rec userRecord
+		err := json.Unmarshal(data[2:], &rec)
+		if err != nil {
+			return nil, err
+		}
+		user.Keys = rec.Credentials.keys()
+		user.CreatedAt = rec.CreatedAt
+		user.LastLogin = rec.LastLogin
+		user.LastIP = rec.LastIP
+		user.PersonaID = rec.PersonaID
+		user.DisplayName = rec.DisplayName
+		user.Flags = rec.Flags
+		return user, nil
+	default:
+		return nil, fmt.Errorf("unknown user record version %v", data[1])
+	}
+}
+
+func (c userCredentials) keys() scram.Keys {
+	return scram.Keys{
+		Salt:       c.Salt,
+		Iterations: c.Iterations,
+		StoredKey:  c.StoredKey,
+		ServerKey:  c.ServerKey,
+	}
+}
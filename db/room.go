@@ -0,0 +1,113 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// RoomOptions are the settings of a room
+type RoomOptions struct {
+	// Persistent rooms exist while they are empty and are created when
+	// the server starts
+	Persistent bool `json:"persistent"`
+	// MaxOccupants limits the number of occupants, zero is unlimited
+	MaxOccupants int `json:"maxOccupants,omitempty"`
+	// MembersOnly rooms can only be joined by members, admins and owners
+	MembersOnly bool `json:"membersOnly,omitempty"`
+	// Password is required to join the room if set
+	Password string `json:"password,omitempty"`
+	// Moderated rooms make occupants without an affiliation visitors
+	Moderated bool `json:"moderated,omitempty"`
+	// HistorySize replaces the configured history limit if not zero,
+	// negative disables history
+	HistorySize int `json:"historySize,omitempty"`
+}
+
+// Room is the stored state of a room, keyed by lowercased bare room JID
+type Room struct {
+	JID       string    `json:"jid"`
+	Subject   string    `json:"subject,omitempty"`
+	SubjectBy string    `json:"subjectBy,omitempty"`
+	SubjectAt time.Time `json:"subjectAt,omitempty"`
+	// Affiliations and Roles map lowercased bare JIDs to the
+	// affiliations and roles set by room admins and moderators
+	Affiliations map[string]string `json:"affiliations,omitempty"`
+	Roles        map[string]string `json:"roles,omitempty"`
+	Options      RoomOptions       `json:"options"`
+}
+
+// GetRoom returns the stored room, or nil if it does not exist.
+func (d DB) GetRoom(jid string) (*Room, error) {
+	var room *Room
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte("rooms")).Get([]byte(strings.ToLower(jid)))
+		if data == nil {
+			return nil
+		}
+		room = new(Room)
+		return json.Unmarshal(data, room)
+	})
+	return room, err
+}
+
+// GetRooms returns all stored rooms
+func (d DB) GetRooms() ([]Room, error) {
+	var rooms []Room
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("rooms")).ForEach(func(k, v []byte) error {
+			var room Room
+			err := json.Unmarshal(v, &room)
+			if err != nil {
+				return err
+			}
+			rooms = append(rooms, room)
+			return nil
+		})
+	})
+	return rooms, err
+}
+
+// UpdateRoom calls fn with the stored room, or a new room if it doesn't
+// exist yet, and stores the result in the same transaction.
+func (d DB) UpdateRoom(jid string, fn func(r *Room) error) error {
+	key := []byte(strings.ToLower(jid))
+	return d.DB.Update(func(tx *bolt.Tx) error {
+		rooms := tx.Bucket([]byte("rooms"))
+		room := &Room{JID: jid}
+		if data := rooms.Get(key); data != nil {
+			err := json.Unmarshal(data, room)
+			if err != nil {
+				return err
+			}
+		}
+		err := fn(room)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(room)
+		if err != nil {
+			return err
+		}
+		return rooms.Put(key, data)
+	})
+}
+
+// DeleteRoom removes a stored room. It returns false if the room does not
+// exist.
+func (d DB) DeleteRoom(jid string) (bool, error) {
+	found := false
+	key := []byte(strings.ToLower(jid))
+	err := d.DB.Update(func(tx *bolt.Tx) error {
+		rooms := tx.Bucket([]byte("rooms"))
+		found = rooms.Get(key) != nil
+		return rooms.Delete(key)
+	})
+	return found, err
+}
@@ -0,0 +1,171 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package events distributes server events to subscribers like the API
+// event stream.
+package events
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redbluescreen/sbrwxmpp/chatlog"
+	"github.com/redbluescreen/sbrwxmpp/metrics"
+)
+
+type Type string
+
+const (
+	Login         Type = "login"
+	Logout        Type = "logout"
+	Kick          Type = "kick"
+	RoomJoin      Type = "room_join"
+	RoomLeave     Type = "room_leave"
+	RoomCreated   Type = "room_created"
+	RoomDestroyed Type = "room_destroyed"
+	// Message events are only sent to subscribers asking for them
+	Message Type = "message"
+)
+
+type Event struct {
+	Type Type      `json:"type"`
+	Time time.Time `json:"time"`
+	// JID is the full JID of the client the event is about
+	JID    string `json:"jid,omitempty"`
+	User   string `json:"user,omitempty"`
+	IP     string `json:"ip,omitempty"`
+	Room   string `json:"room,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// To and Message are set for message events
+	To      string           `json:"to,omitempty"`
+	Message *chatlog.Message `json:"message,omitempty"`
+}
+
+// Filter selects the events of a subscription. Empty fields match
+// everything.
+type Filter struct {
+	// Types defaults to all types except Message
+	Types []Type
+	// User is the local part of a JID
+	User string
+	// Room is the local part of a room JID
+	Room string
+}
+
+func (f Filter) wants(t Type) bool {
+	if len(f.Types) == 0 {
+		return t != Message
+	}
+	for _, typ := range f.Types {
+		if typ == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (f Filter) matches(e *Event) bool {
+	return f.wants(e.Type) &&
+		(f.User == "" || strings.EqualFold(f.User, e.User)) &&
+		(f.Room == "" || strings.EqualFold(f.Room, e.Room))
+}
+
+var metricDropped = metrics.NewCounter("sbrwxmpp_events_dropped_total",
+	"Events dropped because a subscriber's buffer was full")
+
+// Bus sends published events to all matching subscriptions. The zero
+// value is ready to use and a nil Bus discards events.
+type Bus struct {
+	mu       sync.Mutex
+	subs     map[*Subscription]struct{}
+	snapshot atomic.Value // []*Subscription
+}
+
+type Subscription struct {
+	// C receives the events. It is never closed.
+	C       <-chan Event
+	c       chan Event
+	filter  Filter
+	dropped uint64
+}
+
+// Dropped returns the number of events dropped because C was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Subscribe returns a subscription buffering up to size events
+func (b *Bus) Subscribe(f Filter, size int) *Subscription {
+	c := make(chan Event, size)
+	s := &Subscription{C: c, c: c, filter: f}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[*Subscription]struct{})
+	}
+	b.subs[s] = struct{}{}
+	b.updateSnapshot()
+	return s
+}
+
+// Unsubscribe stops sending events to s
+func (b *Bus) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, s)
+	b.updateSnapshot()
+}
+
+// updateSnapshot must be called with the bus locked
+func (b *Bus) updateSnapshot() {
+	all := make([]*Subscription, 0, len(b.subs))
+	for s := range b.subs {
+		all = append(all, s)
+	}
+	b.snapshot.Store(all)
+}
+
+func (b *Bus) subscriptions() []*Subscription {
+	if b == nil {
+		return nil
+	}
+	subs, _ := b.snapshot.Load().([]*Subscription)
+	return subs
+}
+
+// Wants returns whether any subscription accepts events of type t. It
+// lets publishers skip building expensive events.
+func (b *Bus) Wants(t Type) bool {
+	for _, s := range b.subscriptions() {
+		if s.filter.wants(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish sends e to all matching subscriptions without blocking. Events
+// are dropped for subscriptions with a full buffer.
+func (b *Bus) Publish(e Event) {
+	subs := b.subscriptions()
+	if len(subs) == 0 {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, s := range subs {
+		if !s.filter.matches(&e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			metricDropped.Inc()
+		}
+	}
+}
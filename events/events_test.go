@@ -0,0 +1,35 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package events
+
+import "testing"
+
+func TestBus(t *testing.T) {
+	var b Bus
+	all := b.Subscribe(Filter{}, 1)
+	messages := b.Subscribe(Filter{Types: []Type{Message}, User: "sbrw.1"}, 4)
+	if !b.Wants(Message) || !b.Wants(Login) {
+		t.Fatal("unexpected Wants result")
+	}
+	b.Publish(Event{Type: Login, User: "sbrw.1"})
+	b.Publish(Event{Type: Logout, User: "sbrw.1"})
+	b.Publish(Event{Type: Message, User: "sbrw.2"})
+	b.Publish(Event{Type: Message, User: "SBRW.1"})
+	if e := <-all.C; e.Type != Login || e.Time.IsZero() {
+		t.Errorf("got %v, want login", e)
+	}
+	if all.Dropped() != 1 {
+		t.Errorf("dropped %v events, want 1", all.Dropped())
+	}
+	if len(messages.C) != 1 {
+		t.Errorf("got %v messages, want 1", len(messages.C))
+	}
+	b.Unsubscribe(messages)
+	if b.Wants(Message) {
+		t.Error("unsubscribed filter still active")
+	}
+	var nilBus *Bus
+	nilBus.Publish(Event{Type: Login})
+}
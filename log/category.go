@@ -0,0 +1,152 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package log
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/redbluescreen/sbrwxmpp/config"
+)
+
+const (
+	Connections = "connections"
+	Auth        = "auth"
+	Routing     = "routing"
+	API         = "api"
+	Chat        = "chat"
+	Webhook     = "webhook"
+)
+
+var categories = []string{Connections, Auth, Routing, API, Chat, Webhook}
+
+type categorySettings struct {
+	out     io.Writer
+	verbose bool
+}
+
+var (
+	settingsMu     sync.RWMutex
+	settings       = map[string]categorySettings{}
+	defaultVerbose bool
+	format         = FormatText
+	// openFiles are the log files in use, by path
+	openFiles = map[string]*rotatingFile{}
+)
+
+// Configure sets the format and the destination and level of every
+// category. Categories missing from the config log to stderr, at debug
+// level if Verbose is set. It can be called again to reload the
+// configuration, loggers created by NewCategory follow the change.
+func Configure(c *config.Config) error {
+	cfg, verbose := c.Logging, c.Verbose
+	newFormat := c.LogFormat
+	switch newFormat {
+	case "":
+		newFormat = FormatText
+	case FormatText, FormatJSON:
+	default:
+		return fmt.Errorf("unknown log format %q", newFormat)
+	}
+	newSettings := make(map[string]categorySettings)
+	files := make(map[string]*rotatingFile)
+	// limits of files already open, applied once the config is valid
+	limits := make(map[*rotatingFile]config.LoggingCategory)
+	for name, c := range cfg {
+		if !validCategory(name) {
+			return fmt.Errorf("unknown logging category %q", name)
+		}
+		s := categorySettings{verbose: verbose}
+		switch c.Level {
+		case "":
+		case "debug":
+			s.verbose = true
+		case "info":
+			s.verbose = false
+		default:
+			return fmt.Errorf("unknown log level %q for category %v", c.Level, name)
+		}
+		switch c.Destination {
+		case "", "stderr":
+			s.out = os.Stderr
+		case "discard":
+			s.out = ioutil.Discard
+		default:
+			f, ok := files[c.Destination]
+			if !ok {
+				f, ok = currentFile(c.Destination)
+				if ok {
+					limits[f] = c
+				} else {
+					var err error
+					f, err = openRotatingFile(c.Destination, c.MaxSize, c.MaxAge, c.MaxBackups)
+					if err != nil {
+						closeUnused(files)
+						return err
+					}
+				}
+				files[c.Destination] = f
+			}
+			s.out = f
+		}
+		newSettings[name] = s
+	}
+	settingsMu.Lock()
+	settings = newSettings
+	defaultVerbose = verbose
+	format = newFormat
+	oldFiles := openFiles
+	openFiles = files
+	for f, c := range limits {
+		f.setLimits(c.MaxSize, c.MaxAge, c.MaxBackups)
+	}
+	settingsMu.Unlock()
+	for path, f := range oldFiles {
+		if files[path] != f {
+			f.Close()
+		}
+	}
+	return nil
+}
+
+func currentFile(path string) (*rotatingFile, bool) {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	f, ok := openFiles[path]
+	return f, ok
+}
+
+// closeUnused closes files opened by a failed Configure call
+func closeUnused(files map[string]*rotatingFile) {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	for path, f := range files {
+		if openFiles[path] != f {
+			f.Close()
+		}
+	}
+}
+
+func validCategory(name string) bool {
+	for _, c := range categories {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func categoryOutput(category string) (io.Writer, bool, string) {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	s, ok := settings[category]
+	if !ok {
+		return os.Stderr, defaultVerbose, format
+	}
+	return s.out, s.verbose, format
+}
@@ -5,36 +5,243 @@
 package log
 
 import (
-	"log"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fields are structured values attached to log entries
+type Fields map[string]interface{}
+
+// Context fields set with SetField
+const (
+	FieldStreamID   = "streamId"
+	FieldJID        = "jid"
+	FieldRemoteAddr = "remoteAddr"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
 )
 
 type Logger struct {
-	*log.Logger
-	verbose bool
+	// out, format and verbose are only set for loggers created with New,
+	// category loggers look up their settings on every entry
+	out      io.Writer
+	format   string
+	verbose  bool
+	category string
+	// fields are attached to every entry of this logger, see With
+	fields Fields
+	family *family
+}
+
+// family is the set of loggers with different categories for the same
+// connection. They share the prefix and context fields.
+type family struct {
+	sync.Mutex
+	prefix  string
+	context Fields
+	members map[string]*Logger
+}
+
+func (l *Logger) Print(v ...interface{}) {
+	l.output("info", fmt.Sprint(v...))
+}
+
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.output("info", fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Println(v ...interface{}) {
+	l.output("info", fmt.Sprintln(v...))
+}
+
+func (l *Logger) Fatal(v ...interface{}) {
+	l.output("fatal", fmt.Sprint(v...))
+	os.Exit(1)
+}
+
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+	l.output("fatal", fmt.Sprintf(format, v...))
+	os.Exit(1)
 }
 
 func (l *Logger) Debugln(v ...interface{}) {
-	if l.verbose {
-		l.Println(v...)
+	if l.debugEnabled() {
+		l.output("debug", fmt.Sprintln(v...))
 	}
 }
 
 func (l *Logger) Debug(v ...interface{}) {
-	if l.verbose {
-		l.Print(v...)
+	if l.debugEnabled() {
+		l.output("debug", fmt.Sprint(v...))
 	}
 }
 
 func (l *Logger) Debugf(format string, v ...interface{}) {
-	if l.verbose {
-		l.Printf(format, v...)
+	if l.debugEnabled() {
+		l.output("debug", fmt.Sprintf(format, v...))
+	}
+}
+
+// settings returns the output, level and format of the logger
+func (l *Logger) settings() (io.Writer, bool, string) {
+	if l.out != nil {
+		return l.out, l.verbose, l.format
+	}
+	return categoryOutput(l.category)
+}
+
+func (l *Logger) debugEnabled() bool {
+	_, verbose, _ := l.settings()
+	return verbose
+}
+
+// With returns a logger that adds fields to every entry.
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	derived := *l
+	derived.fields = merged
+	return &derived
+}
+
+// Event returns a logger that tags entries with an event name.
+func (l *Logger) Event(event string) *Logger {
+	return l.With(Fields{"event": event})
+}
+
+// Category returns a logger for another category with the same prefix
+// and context fields.
+func (l *Logger) Category(category string) *Logger {
+	l.family.Lock()
+	defer l.family.Unlock()
+	if member, ok := l.family.members[category]; ok {
+		return member
+	}
+	member := newLogger(category)
+	member.family = l.family
+	l.family.members[category] = member
+	return member
+}
+
+// SetField sets a context field for the logger and all loggers returned by
+// Category. In text mode the stream ID replaces the prefix.
+func (l *Logger) SetField(key string, value interface{}) {
+	l.family.Lock()
+	defer l.family.Unlock()
+	l.family.context[key] = value
+}
+
+func (l *Logger) output(level string, msg string) {
+	msg = strings.TrimSuffix(msg, "\n")
+	out, _, format := l.settings()
+	l.family.Lock()
+	prefix := l.family.prefix
+	var context Fields
+	if format == FormatJSON {
+		context = make(Fields, len(l.family.context))
+		for k, v := range l.family.context {
+			context[k] = v
+		}
+	} else if id, ok := l.family.context[FieldStreamID]; ok {
+		prefix = fmt.Sprintf("[%v] ", id)
+	}
+	l.family.Unlock()
+
+	now := time.Now()
+	buf := new(bytes.Buffer)
+	if format == FormatJSON {
+		entry := make(Fields, len(context)+len(l.fields)+4)
+		for k, v := range context {
+			entry[k] = v
+		}
+		for k, v := range l.fields {
+			entry[k] = jsonValue(v)
+		}
+		entry["time"] = now.Format(time.RFC3339Nano)
+		entry["level"] = level
+		entry["category"] = l.category
+		entry["msg"] = msg
+		err := json.NewEncoder(buf).Encode(entry)
+		if err != nil {
+			fmt.Fprintf(buf, "{\"level\":\"error\",\"msg\":%q}\n", "failed to encode log entry: "+err.Error())
+		}
+	} else {
+		buf.WriteString(prefix)
+		buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+		buf.WriteString(msg)
+		for _, k := range sortedKeys(l.fields) {
+			fmt.Fprintf(buf, " %v=%v", k, l.fields[k])
+		}
+		buf.WriteByte('\n')
+	}
+	out.Write(buf.Bytes())
+}
+
+// jsonValue makes values that don't marshal usefully, like errors,
+// readable in JSON output.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
 	}
 }
 
 func New(prefix string, verbose bool) *Logger {
-	return &Logger{
-		Logger:  log.New(os.Stderr, prefix, log.LstdFlags),
+	l := &Logger{
+		out:     os.Stderr,
+		format:  FormatText,
 		verbose: verbose,
 	}
+	l.family = newFamily(prefix, l)
+	return l
+}
+
+// NewCategory creates a logger with the output, level and format
+// configured for category.
+func NewCategory(category string, prefix string) *Logger {
+	l := newLogger(category)
+	l.family = newFamily(prefix, l)
+	return l
+}
+
+func newFamily(prefix string, l *Logger) *family {
+	return &family{
+		prefix:  prefix,
+		context: make(Fields),
+		members: map[string]*Logger{l.category: l},
+	}
+}
+
+func newLogger(category string) *Logger {
+	return &Logger{
+		category: category,
+	}
+}
+
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
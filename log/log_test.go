@@ -0,0 +1,55 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONOutput(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := NewCategory(Connections, "[unknown] ")
+	l.out = buf
+	l.format = FormatJSON
+	l.SetField(FieldStreamID, "abc")
+	l.Event("login").With(Fields{"user": "sbrw.1"}).Printf("Client %v", "authenticated")
+	var entry map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"level":    "info",
+		"category": "connections",
+		"streamId": "abc",
+		"event":    "login",
+		"user":     "sbrw.1",
+		"msg":      "Client authenticated",
+	}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Fatalf("expected %v=%v, got %v", k, v, entry[k])
+		}
+	}
+}
+
+func TestTextOutputUsesStreamIDPrefix(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := NewCategory(Connections, "[unknown] ")
+	l.out = buf
+	l.Println("Accepted TCP connection")
+	l.SetField(FieldStreamID, "abc")
+	l.With(Fields{"room": "test"}).Print("Joined")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !strings.HasPrefix(lines[0], "[unknown] ") || !strings.HasSuffix(lines[0], " Accepted TCP connection") {
+		t.Fatalf("unexpected line %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "[abc] ") || !strings.HasSuffix(lines[1], " Joined room=test") {
+		t.Fatalf("unexpected line %q", lines[1])
+	}
+}
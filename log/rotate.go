@@ -0,0 +1,154 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rotatingFile is a log file that is renamed and replaced by a new one
+// once it gets too large or too old.
+type rotatingFile struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	opened     time.Time
+}
+
+// openRotatingFile opens a log file. maxSize is in megabytes and maxAge in
+// days, zero disables the limit. maxBackups is the number of rotated files
+// to keep, zero keeps all.
+func openRotatingFile(path string, maxSize int, maxAge int, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    int64(maxSize) * 1024 * 1024,
+		maxAge:     time.Duration(maxAge) * 24 * time.Hour,
+		maxBackups: maxBackups,
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return f, f.open()
+}
+
+// setLimits changes the rotation limits of an open file
+func (f *rotatingFile) setLimits(maxSize int, maxAge int, maxBackups int) {
+	f.Lock()
+	defer f.Unlock()
+	f.maxSize = int64(maxSize) * 1024 * 1024
+	f.maxAge = time.Duration(maxAge) * 24 * time.Hour
+	f.maxBackups = maxBackups
+}
+
+// Close closes the file, later writes fail
+func (f *rotatingFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.shouldRotate(len(p)) {
+		err := f.rotate()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate log file %v: %v\n", f.path, err)
+		}
+	}
+	if f.file == nil {
+		return 0, fmt.Errorf("log file %v is not open", f.path)
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) shouldRotate(n int) bool {
+	if f.size == 0 {
+		return false
+	}
+	return (f.maxSize > 0 && f.size+int64(n) > f.maxSize) ||
+		(f.maxAge > 0 && time.Since(f.opened) > f.maxAge)
+}
+
+func (f *rotatingFile) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return err
+	}
+	backup := f.path + "." + time.Now().Format("20060102-150405")
+	for i := 1; fileExists(backup); i++ {
+		backup = fmt.Sprintf("%v.%v-%v", f.path, time.Now().Format("20060102-150405"), i)
+	}
+	err = os.Rename(f.path, backup)
+	if err != nil {
+		return err
+	}
+	err = f.open()
+	if err != nil {
+		return err
+	}
+	return f.removeOldBackups()
+}
+
+func (f *rotatingFile) removeOldBackups() error {
+	if f.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+	if len(backups) <= f.maxBackups {
+		return nil
+	}
+	// The timestamp suffix sorts chronologically
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-f.maxBackups] {
+		err = os.Remove(backup)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,73 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/redbluescreen/sbrwxmpp/config"
+)
+
+func TestRotateBySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbrwxmpp-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.log")
+	f, err := openRotatingFile(path, 0, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.maxSize = 10
+	for i := 0; i < 5; i++ {
+		_, err = f.Write([]byte("12345678\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups, got %v", backups)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != "12345678\n" {
+		t.Fatalf("unexpected log file content %q", data)
+	}
+}
+
+func TestConfigureInvalidKeepsLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbrwxmpp-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.log")
+	c := &config.Config{Logging: map[string]config.LoggingCategory{
+		Auth: {Destination: path, MaxBackups: 2},
+	}}
+	if err := Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(&config.Config{})
+	c.Logging = map[string]config.LoggingCategory{
+		Auth:      {Destination: path, MaxBackups: 5},
+		"unknown": {},
+	}
+	// Categories are checked in map order, repeat so the valid one comes
+	// first at least once
+	for i := 0; i < 10; i++ {
+		if err := Configure(c); err == nil {
+			t.Fatal("expected error for unknown category")
+		}
+	}
+	f, _ := currentFile(path)
+	if f.maxBackups != 2 {
+		t.Errorf("limits changed by invalid config, maxBackups = %v", f.maxBackups)
+	}
+}
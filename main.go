@@ -5,26 +5,37 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	stdlog "log"
 	"net"
 	"os"
-	"path"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 
 	"github.com/redbluescreen/sbrwxmpp/api"
-	"github.com/redbluescreen/sbrwxmpp/certgen"
+	"github.com/redbluescreen/sbrwxmpp/chatlog"
 	pconfig "github.com/redbluescreen/sbrwxmpp/config"
 	"github.com/redbluescreen/sbrwxmpp/db"
+	"github.com/redbluescreen/sbrwxmpp/events"
 	"github.com/redbluescreen/sbrwxmpp/log"
 	"github.com/redbluescreen/sbrwxmpp/tls"
 	"github.com/redbluescreen/sbrwxmpp/xmpp"
 )
 
-var defaultConfig = `# Remove localhost to make the server listen publicly
+var defaultConfig = `# Every key can be overridden by an environment variable like
+# SBRWXMPP_API_KEY (SBRWXMPP_ followed by the key with _ for .). Arrays
+# like rooms take a JSON value: SBRWXMPP_ROOMS='[{"name": "channel.en__1"}]'
+
+# Remove localhost to make the server listen publicly
 addr = "localhost:5222"
 # cert = "cert.pem"
 # certkey = "key.pem"
@@ -33,24 +44,79 @@ addr = "localhost:5222"
 domain = "localhost"
 
 verbose = false
+# Log format, "text" or "json"
+logformat = "text"
 
 [api]
 addr = "localhost:8087"
-key = "<<APIKEY>>"`
+key = "<<APIKEY>>"
+
+# Announcement sent to players when the server shuts down
+# [shutdown]
+# message = "The server is restarting"
+# timeout = 10 # seconds
+
+# Per-client send queue
+# [outbound]
+# queuesize = 1024
+# overflow = "disconnect" # or "drop-oldest"
+
+# Groupchat messages replayed to players joining a room
+# [history]
+# maxstanzas = 20 # negative disables history
+# maxage = 0 # seconds, 0 for no limit
+# [[history.rooms]]
+# pattern = "group.*@conference.*"
+# maxstanzas = 50
+
+# Rooms created when the server starts, they are never destroyed
+# [[rooms]]
+# name = "channel.en__1"
+# maxoccupants = 0 # 0 for no limit
+# membersonly = false
+# password = ""
+# moderated = false # players without an affiliation can't talk
+# historysize = 0 # 0 uses the history limits, negative disables history
+
+# Log categories: connections, auth, routing, api, chat, webhook
+# [logging.auth]
+# destination = "logs/auth.log" # stderr, discard or a file path
+# level = "debug"
+# maxsize = 10 # megabytes
+# maxage = 7 # days
+# maxbackups = 5`
+
+var (
+	configPath         = flag.String("config", pconfig.DefaultPath, "path of the configuration file")
+	dataDir            = flag.String("data-dir", ".", "directory of the database and generated certificates")
+	printDefaultConfig = flag.Bool("print-default-config", false, "print the default configuration and exit")
+)
+
+func generateDefaultConfig() string {
+	return strings.ReplaceAll(defaultConfig, "<<APIKEY>>", xmpp.RandomStringSecure(32)) + "\n"
+}
 
 func main() {
+	flag.Usage = commandUsage
+	flag.Parse()
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+	if *printDefaultConfig {
+		fmt.Print(generateDefaultConfig())
+		return
+	}
 	runtime.SetMutexProfileFraction(5)
 
-	config, err := pconfig.LoadConfig()
+	config, err := pconfig.LoadConfig(*configPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			stdlog.Printf("No configuration found, generating")
-			genConfig := strings.ReplaceAll(defaultConfig, "<<APIKEY>>", xmpp.RandomStringSecure(32))
-			err = ioutil.WriteFile("sbrwxmpp.toml", []byte(genConfig), os.ModePerm)
+			stdlog.Printf("No configuration found, generating %v", *configPath)
+			err = ioutil.WriteFile(*configPath, []byte(generateDefaultConfig()), 0600)
 			if err != nil {
 				stdlog.Fatalf("Failed to save config: %v\n", err)
 			}
-			config, err = pconfig.LoadConfig()
+			config, err = pconfig.LoadConfig(*configPath)
 			if err != nil {
 				stdlog.Fatalf("Failed to read config: %v\n", err)
 			}
@@ -59,62 +125,139 @@ func main() {
 		}
 	}
 
-	// TODO: logger init based on log config
-	logger := log.New("", config.Verbose)
+	err = log.Configure(config)
+	if err != nil {
+		stdlog.Fatalf("Failed to configure logging: %v\n", err)
+	}
+	logger := log.NewCategory(log.Connections, "")
 
 	ln, err := net.Listen("tcp", config.Addr)
 	if err != nil {
 		logger.Fatalf("Failed to listen: %v\n", err)
 	}
 
-	if config.Cert == "" || config.CertKey == "" {
-		logger.Print("No certificate specified, using selfsigned certificate")
-		config.Cert = path.Join("sbrwxmpp-certs", config.Domain+".crt")
-		config.CertKey = path.Join("sbrwxmpp-certs", config.Domain+".key")
-		if _, err := os.Stat(config.Cert); os.IsNotExist(err) {
-			logger.Printf("No certificate found for %v, generating new", config.Domain)
-			_ = os.Mkdir("sbrwxmpp-certs", 0600)
-			err = certgen.GenerateCertificate("sbrwxmpp-certs", config.Domain)
-			if err != nil {
-				logger.Fatalf("Failed to generate certificate: %v\n", err)
-			}
-		}
+	err = os.MkdirAll(*dataDir, 0700)
+	if err != nil {
+		logger.Fatalf("Failed to create data directory: %v\n", err)
 	}
-
-	cert, err := tls.LoadX509KeyPair(config.Cert, config.CertKey)
+	certDir := filepath.Join(*dataDir, "sbrwxmpp-certs")
+	cert, err := loadCertificate(config, certDir, logger)
 	if err != nil {
 		logger.Fatalf("Failed to load certs: %v\n", err)
 	}
+	store := pconfig.NewStore(config)
+	reloader := &reloader{
+		path:    *configPath,
+		certDir: certDir,
+		store:   store,
+		logger:  logger,
+	}
+	reloader.cert.Store(cert)
 	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
+		GetCertificate: reloader.getCertificate,
 		// Just in case, game doesn't like data being split
 		// into multiple records
 		DynamicRecordSizingDisabled: true,
 	}
 
-	bdb, err := bolt.Open("sbrwxmpp.db", 0600, nil)
+	bdb, err := bolt.Open(filepath.Join(*dataDir, "sbrwxmpp.db"), 0600, nil)
 	if err != nil {
 		logger.Fatalf("Failed to open DB: %v\n", err)
 	}
-	db := &db.DB{bdb}
+	db := &db.DB{DB: bdb}
 	err = db.Initialize()
 	if err != nil {
 		logger.Fatalf("Failed to initialize DB: %v\n", err)
 	}
 
+	chatLog, err := chatlog.New(bdb, log.NewCategory(log.Chat, "[chatlog] "),
+		time.Duration(config.ChatLog.RetentionDays)*24*time.Hour)
+	if err != nil {
+		logger.Fatalf("Failed to initialize chatlog: %v\n", err)
+	}
+
 	server := &xmpp.XmppServer{
-		Logger: logger,
-		DB:     db,
-		Config: config,
+		Logger:  logger,
+		DB:      db,
+		Config:  store,
+		ChatLog: chatLog,
+		Events:  &events.Bus{},
 	}
 
 	apiSrv := api.Server{
-		XMPP:   server,
-		DB:     db,
-		Config: config,
-		Logger: stdlog.New(os.Stderr, "[api] ", stdlog.LstdFlags),
+		XMPP:    server,
+		DB:      db,
+		Config:  store,
+		Logger:  log.NewCategory(log.API, "[api] "),
+		ChatLog: chatLog,
+		Reload:  reloader.reload,
 	}
-	go apiSrv.Run()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				logger.Print("Received SIGHUP, reloading configuration")
+				_, err := reloader.reload()
+				if err != nil {
+					logger.Printf("Failed to reload configuration: %v", err)
+				}
+				continue
+			}
+			logger.Printf("Received %v, shutting down", sig)
+			cancel()
+			return
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := db.DeleteExpired()
+				if err != nil {
+					logger.Printf("Failed to delete expired bans and mutes: %v", err)
+				}
+			}
+		}
+	}()
+
+	apiDone := make(chan struct{})
+	go func() {
+		defer close(apiDone)
+		err := apiSrv.Run(ctx)
+		if err != nil {
+			logger.Printf("API server failed: %v", err)
+		}
+	}()
 	logger.Print("Server running!")
-	server.Run(ln, tlsConfig)
+	err = server.Run(ctx, ln, tlsConfig)
+	if err != nil {
+		logger.Printf("Failed to accept connections: %v", err)
+		cancel()
+	}
+
+	timeout := time.Duration(store.Get().Shutdown.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	sctx, scancel := context.WithTimeout(context.Background(), timeout)
+	defer scancel()
+	err = server.Shutdown(sctx)
+	if err != nil {
+		logger.Printf("Failed to close all connections: %v", err)
+	}
+	<-apiDone
+	chatLog.Close()
+	err = bdb.Close()
+	if err != nil {
+		logger.Printf("Failed to close DB: %v", err)
+	}
+	logger.Print("Server stopped")
 }
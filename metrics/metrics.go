@@ -0,0 +1,303 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package metrics implements counters, gauges and histograms that can be
+// exported in the Prometheus text format. All updates are lock free
+// except for creating new label combinations.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type metric interface {
+	write(w *bufio.Writer, name string, labels string)
+}
+
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) write(w *bufio.Writer, name string, labels string) {
+	fmt.Fprintf(w, "%v%v %v\n", name, labels, c.Value())
+}
+
+type Gauge struct {
+	v int64
+}
+
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.v, 1)
+}
+
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.v, -1)
+}
+
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.v, v)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+func (g *Gauge) write(w *bufio.Writer, name string, labels string) {
+	fmt.Fprintf(w, "%v%v %v\n", name, labels, g.Value())
+}
+
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	// sum is a float64 stored as bits
+	sum uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			atomic.AddUint64(&h.counts[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string, labels string) {
+	var cumulative uint64
+	for i, b := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		le := strconv.FormatFloat(b, 'g', -1, 64)
+		fmt.Fprintf(w, "%v_bucket%v %v\n", name, addLabel(labels, "le", le), cumulative)
+	}
+	count := atomic.LoadUint64(&h.count)
+	fmt.Fprintf(w, "%v_bucket%v %v\n", name, addLabel(labels, "le", "+Inf"), count)
+	sum := math.Float64frombits(atomic.LoadUint64(&h.sum))
+	fmt.Fprintf(w, "%v_sum%v %v\n", name, labels, strconv.FormatFloat(sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%v_count%v %v\n", name, labels, count)
+}
+
+// vec is a set of metrics of the same kind, distinguished by label values
+type vec struct {
+	sync.RWMutex
+	labels  []string
+	metrics map[string]metric
+	create  func() metric
+}
+
+func newVec(labels []string, create func() metric) *vec {
+	return &vec{
+		labels:  labels,
+		metrics: make(map[string]metric),
+		create:  create,
+	}
+}
+
+func (v *vec) with(values []string) metric {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: expected %v label values, got %v", len(v.labels), len(values)))
+	}
+	key := formatLabels(v.labels, values)
+	v.RLock()
+	m, ok := v.metrics[key]
+	v.RUnlock()
+	if ok {
+		return m
+	}
+	v.Lock()
+	defer v.Unlock()
+	if m, ok = v.metrics[key]; !ok {
+		m = v.create()
+		v.metrics[key] = m
+	}
+	return m
+}
+
+func (v *vec) delete(values []string) {
+	v.Lock()
+	defer v.Unlock()
+	delete(v.metrics, formatLabels(v.labels, values))
+}
+
+func (v *vec) write(w *bufio.Writer, name string, _ string) {
+	v.RLock()
+	keys := make([]string, 0, len(v.metrics))
+	for k := range v.metrics {
+		keys = append(keys, k)
+	}
+	metrics := make([]metric, len(keys))
+	sort.Strings(keys)
+	for i, k := range keys {
+		metrics[i] = v.metrics[k]
+	}
+	v.RUnlock()
+	for i, m := range metrics {
+		m.write(w, name, keys[i])
+	}
+}
+
+type CounterVec struct {
+	*vec
+}
+
+func (v CounterVec) With(values ...string) *Counter {
+	return v.with(values).(*Counter)
+}
+
+type GaugeVec struct {
+	*vec
+}
+
+func (v GaugeVec) With(values ...string) *Gauge {
+	return v.with(values).(*Gauge)
+}
+
+func (v GaugeVec) Delete(values ...string) {
+	v.delete(values)
+}
+
+type HistogramVec struct {
+	*vec
+}
+
+func (v HistogramVec) With(values ...string) *Histogram {
+	return v.with(values).(*Histogram)
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "=\"" + escapeLabel(values[i]) + "\""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func addLabel(labels string, name string, value string) string {
+	l := name + "=\"" + escapeLabel(value) + "\""
+	if labels == "" {
+		return "{" + l + "}"
+	}
+	return labels[:len(labels)-1] + "," + l + "}"
+}
+
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+type entry struct {
+	name   string
+	help   string
+	typ    string
+	metric metric
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []entry
+)
+
+func register(name, help, typ string, m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, e := range registry {
+		if e.name == name {
+			panic("metrics: duplicate metric " + name)
+		}
+	}
+	registry = append(registry, entry{name: name, help: help, typ: typ, metric: m})
+}
+
+func NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	register(name, help, "counter", c)
+	return c
+}
+
+func NewCounterVec(name, help string, labels ...string) CounterVec {
+	v := CounterVec{newVec(labels, func() metric { return &Counter{} })}
+	register(name, help, "counter", v.vec)
+	return v
+}
+
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	register(name, help, "gauge", g)
+	return g
+}
+
+func NewGaugeVec(name, help string, labels ...string) GaugeVec {
+	v := GaugeVec{newVec(labels, func() metric { return &Gauge{} })}
+	register(name, help, "gauge", v.vec)
+	return v
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	register(name, help, "histogram", h)
+	return h
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) HistogramVec {
+	v := HistogramVec{newVec(labels, func() metric { return newHistogram(buckets) })}
+	register(name, help, "histogram", v.vec)
+	return v
+}
+
+// WriteText writes all registered metrics in the Prometheus text format
+func WriteText(w io.Writer) error {
+	registryMu.Lock()
+	entries := make([]entry, len(registry))
+	copy(entries, registry)
+	registryMu.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	bw := bufio.NewWriter(w)
+	for _, e := range entries {
+		fmt.Fprintf(bw, "# HELP %v %v\n", e.name, e.help)
+		fmt.Fprintf(bw, "# TYPE %v %v\n", e.name, e.typ)
+		e.metric.write(bw, e.name, "")
+	}
+	return bw.Flush()
+}
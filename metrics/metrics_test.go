@@ -0,0 +1,42 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	c := NewCounterVec("test_messages_total", "Messages.", "type")
+	c.With("chat").Inc()
+	c.With("group\"chat").Add(2)
+	h := NewHistogram("test_duration_seconds", "Duration.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	var buf bytes.Buffer
+	if err := WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"# TYPE test_messages_total counter",
+		`test_messages_total{type="chat"} 1`,
+		`test_messages_total{type="group\"chat"} 2`,
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{le="0.1"} 1`,
+		`test_duration_seconds_bucket{le="1"} 2`,
+		`test_duration_seconds_bucket{le="+Inf"} 3`,
+		"test_duration_seconds_sum 2.55",
+		"test_duration_seconds_count 3",
+	}
+	for _, line := range want {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing %q in output:\n%v", line, buf.String())
+		}
+	}
+}
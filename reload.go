@@ -0,0 +1,85 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/redbluescreen/sbrwxmpp/certgen"
+	pconfig "github.com/redbluescreen/sbrwxmpp/config"
+	"github.com/redbluescreen/sbrwxmpp/log"
+	"github.com/redbluescreen/sbrwxmpp/tls"
+)
+
+// reloader applies a reloaded configuration to the running server
+type reloader struct {
+	mu      sync.Mutex
+	path    string
+	certDir string
+	store   *pconfig.Store
+	cert    atomic.Value // *tls.Certificate
+	logger  *log.Logger
+}
+
+// reload reads the configuration file again and applies it. It returns
+// the changed fields that need a restart to take effect.
+func (r *reloader) reload() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	next, err := pconfig.LoadConfig(r.path)
+	if err != nil {
+		return nil, err
+	}
+	config, restart := pconfig.Reload(r.store.Get(), next)
+	cert, err := loadCertificate(config, r.certDir, r.logger)
+	if err != nil {
+		return nil, err
+	}
+	err = log.Configure(config)
+	if err != nil {
+		return nil, err
+	}
+	r.cert.Store(cert)
+	r.store.Set(config)
+	if len(restart) > 0 {
+		r.logger.With(log.Fields{"restartRequired": strings.Join(restart, ",")}).
+			Print("Configuration reloaded, some changes need a restart")
+	} else {
+		r.logger.Print("Configuration reloaded")
+	}
+	return restart, nil
+}
+
+func (r *reloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load().(*tls.Certificate), nil
+}
+
+// loadCertificate loads the configured certificate. If none is configured
+// a self-signed certificate for the domain in certDir is used and
+// generated if needed.
+func loadCertificate(config *pconfig.Config, certDir string, logger *log.Logger) (*tls.Certificate, error) {
+	if config.Cert == "" || config.CertKey == "" {
+		logger.Print("No certificate specified, using selfsigned certificate")
+		config.Cert = filepath.Join(certDir, config.Domain+".crt")
+		config.CertKey = filepath.Join(certDir, config.Domain+".key")
+		if _, err := os.Stat(config.Cert); os.IsNotExist(err) {
+			logger.Printf("No certificate found for %v, generating new", config.Domain)
+			_ = os.Mkdir(certDir, 0700)
+			err = certgen.GenerateCertificate(certDir, config.Domain)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(config.Cert, config.CertKey)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
@@ -0,0 +1,72 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package scram implements the key derivation of SCRAM-SHA-1 (RFC 5802).
+package scram
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	DefaultIterations = 4096
+	SaltLength        = 16
+)
+
+// Keys are the values a server needs to verify a SCRAM exchange
+// without knowing the password.
+type Keys struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewSalt returns a random salt of SaltLength bytes.
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltLength)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+// DeriveKeys computes the stored and server key for a password.
+func DeriveKeys(password []byte, salt []byte, iterations int) Keys {
+	salted := pbkdf2.Key(password, salt, iterations, sha1.Size, sha1.New)
+	clientKey := HMAC(salted, []byte("Client Key"))
+	storedKey := sha1.Sum(clientKey)
+	return Keys{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  HMAC(salted, []byte("Server Key")),
+	}
+}
+
+func HMAC(key, data []byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// VerifyProof checks a client proof for the given auth message and
+// returns the server signature to send back on success.
+func (k Keys) VerifyProof(authMessage, proof []byte) ([]byte, bool) {
+	if len(proof) != sha1.Size {
+		return nil, false
+	}
+	clientSignature := HMAC(k.StoredKey, authMessage)
+	clientKey := make([]byte, sha1.Size)
+	for i := range clientKey {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha1.Sum(clientKey)
+	if !hmac.Equal(storedKey[:], k.StoredKey) {
+		return nil, false
+	}
+	return HMAC(k.ServerKey, authMessage), true
+}
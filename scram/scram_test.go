@@ -0,0 +1,31 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package scram
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// Example exchange from RFC 5802 section 5
+func TestVerifyProof(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString("QSXCR+Q6sek8bf92")
+	keys := DeriveKeys([]byte("pencil"), salt, 4096)
+	authMessage := "n=user,r=fyko+d2lbbFgONRv9qkxdawL," +
+		"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096," +
+		"c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j"
+	proof, _ := base64.StdEncoding.DecodeString("v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=")
+	signature, ok := keys.VerifyProof([]byte(authMessage), proof)
+	if !ok {
+		t.Fatal("valid proof rejected")
+	}
+	if base64.StdEncoding.EncodeToString(signature) != "rmF9pqV8S7suAoZWja4dJRkFsKQ=" {
+		t.Fatal("server signature mismatch")
+	}
+	proof[0] ^= 1
+	if _, ok := keys.VerifyProof([]byte(authMessage), proof); ok {
+		t.Fatal("invalid proof accepted")
+	}
+}
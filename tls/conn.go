@@ -43,6 +43,7 @@ type Conn struct {
 	handshakes       int
 	didResume        bool // whether this connection was a session resumption
 	cipherSuite      uint16
+	selectedSuite    uint16   // cipherSuite, but set before the handshake completes
 	ocspResponse     []byte   // stapled OCSP response
 	scts             [][]byte // signed certificate timestamps from server
 	peerCertificates []*x509.Certificate
@@ -1395,6 +1396,16 @@ func (c *Conn) ConnectionState() ConnectionState {
 	return state
 }
 
+// NegotiatedParameters returns the protocol version and cipher suite
+// selected by the server so far. Unlike ConnectionState it can be used after
+// a failed handshake, values that weren't negotiated yet are zero.
+func (c *Conn) NegotiatedParameters() (version, cipherSuite uint16) {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	return c.vers, c.selectedSuite
+}
+
 // OCSPResponse returns the stapled OCSP response from the TLS server, if
 // any. (Only valid for client connections.)
 func (c *Conn) OCSPResponse() []byte {
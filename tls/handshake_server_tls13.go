@@ -166,6 +166,7 @@ func (hs *serverHandshakeStateTLS13) processClientHello() error {
 		return errors.New("tls: no cipher suite supported by both client and server")
 	}
 	c.cipherSuite = hs.suite.id
+	c.selectedSuite = hs.suite.id
 	hs.hello.cipherSuite = hs.suite.id
 	hs.transcript = hs.suite.hash.New()
 
@@ -0,0 +1,199 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redbluescreen/sbrwxmpp/db"
+	"github.com/redbluescreen/sbrwxmpp/events"
+	"github.com/redbluescreen/sbrwxmpp/log"
+	"github.com/redbluescreen/sbrwxmpp/scram"
+)
+
+const (
+	nsIqAuth  = "jabber:iq:auth"
+	nsBind    = "urn:ietf:params:xml:ns:xmpp-bind"
+	nsSession = "urn:ietf:params:xml:ns:xmpp-session"
+)
+
+// XEP-0078 Non-SASL Authentication, used by the game
+var iqAuthHandler = IqHandler{
+	Get:             handleIqAuthGet,
+	Set:             handleIqAuthSet,
+	Unauthenticated: true,
+}
+
+func handleIqAuthGet(c *XmppClient, iq Iq) (string, error) {
+	c.logger.Category(log.Auth).Debug("Received authentication IQ")
+	return "<query xmlns='jabber:iq:auth'><username/><password/><resource/></query>", nil
+}
+
+func handleIqAuthSet(c *XmppClient, iq Iq) (string, error) {
+	c.logger.Category(log.Auth).Debug("Received authentication IQ")
+	uc, _ := iq.Payload.GetChild("username")
+	pc, _ := iq.Payload.GetChild("password")
+	rc, _ := iq.Payload.GetChild("resource")
+	if c.saslUser != "" {
+		return "", ErrNotAllowed
+	}
+	ok, err := c.server.checkPassword(uc.Text, pc.Text)
+	if err != nil {
+		c.logger.Category(log.Auth).Printf("error getting user: %v", err)
+		return "", ErrInternalServerError
+	}
+	if !ok {
+		metricAuthFailures.With("iq-auth").Inc()
+		c.logger.Category(log.Auth).Event("auth_failed").With(log.Fields{"user": uc.Text}).
+			Print("Authentication failed")
+		return "", ErrNotAuthorized
+	}
+	ban, err := c.server.findBan(uc.Text, c.RemoteIP())
+	if err != nil {
+		c.logger.Category(log.Auth).Printf("error checking bans: %v", err)
+		return "", ErrInternalServerError
+	}
+	if ban != nil {
+		c.logger.Category(log.Auth).Event("login_banned").With(log.Fields{"user": uc.Text}).
+			Print("Rejecting login of banned user")
+		return "", ErrNotAuthorized.WithText(banMessage(ban))
+	}
+	c.bindJID(uc.Text, rc.Text)
+	return "", nil
+}
+
+// RFC 6120 resource binding, used after SASL authentication
+var iqBindHandler = IqHandler{
+	Set:             handleIqBind,
+	Unauthenticated: true,
+}
+
+func handleIqBind(c *XmppClient, iq Iq) (string, error) {
+	if c.saslUser == "" {
+		return "", ErrNotAuthorized
+	}
+	if c.authenticated {
+		return "", ErrNotAllowed
+	}
+	var resource string
+	if rc, ok := iq.Payload.GetChild("resource"); ok {
+		resource = rc.Text
+	}
+	if resource == "" {
+		resource = RandomStringSecure(10)
+	}
+	c.bindJID(c.saslUser, resource)
+	return "<bind xmlns='" + nsBind + "'><jid>" + XMLEscape(c.JID) + "</jid></bind>", nil
+}
+
+// RFC 3921 session establishment, kept for older clients
+var iqSessionHandler = IqHandler{
+	Set: func(c *XmppClient, iq Iq) (string, error) {
+		return "", nil
+	},
+}
+
+// bindJID sets the full JID of an authenticated client, replacing any
+// other session of the same user.
+func (c *XmppClient) bindJID(user, resource string) {
+	// The registry is keyed by JID, so re-register on re-authentication
+	registered := c.server.sessions.remove(c)
+	c.JID = user + "@" + c.server.Config.Get().Domain + "/" + resource
+	c.stats.jid.Store(c.JID)
+	if registered {
+		c.server.sessions.add(c)
+	}
+	c.logger.SetField(log.FieldJID, c.JID)
+	c.logger.Category(log.Auth).Event("login").Print("Client authenticated")
+	err := c.server.DB.RecordLogin(user, c.RemoteIP())
+	if err != nil {
+		c.logger.Category(log.Auth).Printf("error recording login: %v", err)
+	}
+	// Kick all sessions of the user, we don't support multiple resources
+	for _, cl := range c.server.sessions.find(bareJID(c.JID)) {
+		if cl == c {
+			continue
+		}
+		cl.Kick("conflict", "<conflict xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>")
+	}
+	if !c.authenticated {
+		metricSessions.Inc()
+	}
+	c.authenticated = true
+	atomic.StoreUint32(&c.stats.authenticated, 1)
+	c.server.Events.Publish(c.event(events.Login))
+}
+
+func (s *XmppServer) checkPassword(name, password string) (bool, error) {
+	user, err := s.DB.GetUser(name)
+	if err != nil || user == nil {
+		return false, err
+	}
+	return user.CheckPassword([]byte(password)), nil
+}
+
+// scramKeys returns the SCRAM-SHA-1 keys for a user. found is false if the
+// user does not exist.
+func (s *XmppServer) scramKeys(name string) (keys scram.Keys, found bool, err error) {
+	user, err := s.DB.GetUser(name)
+	if err != nil || user == nil {
+		return keys, false, err
+	}
+	return user.Keys, true, nil
+}
+
+// unknownUserSalt returns the salt presented for a user that doesn't
+// exist. It is derived from the name, so repeated attempts get the same
+// salt like an existing user would.
+func (s *XmppServer) unknownUserSalt(name string) []byte {
+	s.saltOnce.Do(func() {
+		s.saltSecret = []byte(RandomStringSecure(32))
+	})
+	return scram.HMAC(s.saltSecret, []byte(name))[:scram.SaltLength]
+}
+
+// findBan returns the ban preventing a user from logging in, or nil
+func (s *XmppServer) findBan(name, ip string) (*db.Ban, error) {
+	ban, err := s.DB.FindBan(name, ip)
+	if err != nil || ban != nil {
+		return ban, err
+	}
+	user, err := s.DB.GetUser(name)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	if user.Flags.Has(db.UserBanned) {
+		return &db.Ban{User: name}, nil
+	}
+	return nil, nil
+}
+
+func banMessage(ban *db.Ban) string {
+	msg := "You are banned"
+	if ban.Reason != "" {
+		msg += ": " + ban.Reason
+	}
+	if !ban.ExpiresAt.IsZero() {
+		msg += " (until " + formatExpiry(ban.ExpiresAt) + ")"
+	}
+	return msg
+}
+
+func formatExpiry(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04 MST")
+}
+
+// KickBanned disconnects all clients matching a ban
+func (s *XmppServer) KickBanned(ban *db.Ban) {
+	for _, client := range s.sessions.all() {
+		user := strings.Split(client.JID, "@")[0]
+		if ban.Matches(user, client.RemoteIP()) {
+			client.Kick("ban", "<not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>"+
+				"<text xmlns='urn:ietf:params:xml:ns:xmpp-streams'>"+XMLEscape(banMessage(ban))+"</text>")
+		}
+	}
+}
@@ -0,0 +1,26 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/redbluescreen/sbrwxmpp/scram"
+)
+
+func TestUnknownUserSalt(t *testing.T) {
+	s := &XmppServer{}
+	salt := s.unknownUserSalt("sbrw.1")
+	if len(salt) != scram.SaltLength {
+		t.Fatalf("got salt of %v bytes, want %v", len(salt), scram.SaltLength)
+	}
+	if !bytes.Equal(s.unknownUserSalt("sbrw.1"), salt) {
+		t.Error("salt changed between attempts")
+	}
+	if bytes.Equal(s.unknownUserSalt("sbrw.2"), salt) {
+		t.Error("different users got the same salt")
+	}
+}
@@ -5,27 +5,33 @@
 package xmpp
 
 import (
-	"bytes"
 	"encoding/xml"
 	"fmt"
 	"net"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/redbluescreen/sbrwxmpp/chatlog"
 	"github.com/redbluescreen/sbrwxmpp/cmdhook"
+	"github.com/redbluescreen/sbrwxmpp/events"
 	"github.com/redbluescreen/sbrwxmpp/log"
 	"github.com/redbluescreen/sbrwxmpp/tls"
 	xmlstream "github.com/redbluescreen/sbrwxmpp/xmlstream2"
 )
 
 type XmppClient struct {
+	// stats is first to keep its 64-bit counters aligned
+	stats         clientStats
+	connectedAt   time.Time
 	tcpConn       net.Conn
 	tlsConn       *tls.Conn
 	tlsConfig     *tls.Config
 	authenticated bool
+	sasl          saslMechanism
+	saslUser      string
 	stream        *xmlstream.ElementStream
 	logger        *log.Logger
 	JID           string
@@ -33,6 +39,37 @@ type XmppClient struct {
 	streamEnd     chan struct{}
 	streamClosed  uint32
 	webhook       *cmdhook.CmdHook
+	roomsMu       sync.Mutex
+	rooms         []*XmppRoom
+	queue         *sendQueue
+	writerQuit    chan struct{}
+	writerDone    chan struct{}
+	overflow      chan struct{}
+	overflowOnce  sync.Once
+}
+
+func (c *XmppClient) addRoom(r *XmppRoom) {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	c.rooms = append(c.rooms, r)
+}
+
+func (c *XmppClient) removeRoom(r *XmppRoom) {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	for i, room := range c.rooms {
+		if room == r {
+			c.rooms = append(c.rooms[:i], c.rooms[i+1:]...)
+			return
+		}
+	}
+}
+
+// JoinedRooms returns a copy of the rooms the client is a member of
+func (c *XmppClient) JoinedRooms() []*XmppRoom {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	return append([]*XmppRoom(nil), c.rooms...)
 }
 
 func (c *XmppClient) closeConn() {
@@ -43,6 +80,15 @@ func (c *XmppClient) closeConn() {
 	}
 }
 
+// RemoteIP returns the IP address of the client
+func (c *XmppClient) RemoteIP() string {
+	host, _, err := net.SplitHostPort(c.tcpConn.RemoteAddr().String())
+	if err != nil {
+		return c.tcpConn.RemoteAddr().String()
+	}
+	return host
+}
+
 func (c *XmppClient) CloseError(err string) {
 	c.write("<stream:error>" + err + "</stream:error>")
 	c.Close()
@@ -59,13 +105,21 @@ func (c *XmppClient) Close() {
 }
 
 func (c *XmppClient) HandleConnection() {
+	go c.writeLoop()
 	defer func() {
 		if r := recover(); r != nil {
 			c.logger.Printf("Panic handling connection: %v\n%v", r, string(debug.Stack()))
 		}
 		c.server.RemoveClient(c)
+		close(c.writerQuit)
+		<-c.writerDone
 		c.closeConn()
-		c.logger.Println("Connection closed")
+		metricConnectedClients.Dec()
+		if c.authenticated {
+			metricSessions.Dec()
+			c.server.Events.Publish(c.event(events.Logout))
+		}
+		c.logger.Event("connection_closed").Print("Connection closed")
 	}()
 	stream, err := xmlstream.NewStream(c.tcpConn)
 	if err != nil {
@@ -90,6 +144,7 @@ func (c *XmppClient) HandleConnection() {
 			return
 		}
 
+		c.stats.stanzaReceived()
 		err = c.handleXmlElement(e)
 		if err != nil {
 			c.logger.Printf("error handling element: %v", err)
@@ -110,12 +165,20 @@ func (c *XmppClient) handleRootElement(e *xmlstream.ElementStream) {
 	c.sendStreamStart(from)
 	if c.tlsConn == nil {
 		c.sendPreTLSStreamFeatures()
-	} else {
+	} else if c.saslUser == "" {
 		c.sendPostTLSStreamFeatures()
+	} else {
+		c.sendPostSASLStreamFeatures()
 	}
 }
 
 func (c *XmppClient) handleXmlElement(e xmlstream.Element) error {
+	if e.Name.Space == nsSASL {
+		if c.tlsConn != nil {
+			c.handleSASL(e)
+		}
+		return nil
+	}
 	switch e.Name.Local {
 	case "starttls":
 		if c.tlsConn == nil {
@@ -138,163 +201,112 @@ func (c *XmppClient) handleXmlElement(e xmlstream.Element) error {
 	return nil
 }
 
-func (c *XmppClient) handleIq(e xmlstream.Element) {
-	id := e.GetAttr("id")
-	typ := e.GetAttr("type")
-	if id == "" || (typ != "get" && typ != "set") {
-		// TODO: return iq error
-		c.logger.Println("iq error: id or type invalid")
-		return
-	}
-	for _, el := range e.Children {
-		if el.Name.Local == "query" && el.Name.Space == "jabber:iq:auth" {
-			c.logger.Debug("Received authentication IQ")
-			if typ == "get" {
-				s := "<iq type='result' id='%v'><query xmlns='jabber:iq:auth'><username/><password/><resource/></query></iq>"
-				c.write(fmt.Sprintf(s, id))
-			} else {
-				uc, _ := el.GetChild("username")
-				pc, _ := el.GetChild("password")
-				rc, _ := el.GetChild("resource")
-				user, err := c.server.DB.GetUser(uc.Text)
-				if err != nil {
-					c.logger.Printf("error getting user: %v", err)
-					s := "<iq type='error' id='%v'><error type='cancel'>" +
-						"<internal-server-error xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>" +
-						"</error></iq>"
-					c.write(fmt.Sprintf(s, id))
-					continue
-				}
-				if !bytes.Equal(user.Password, []byte(pc.Text)) {
-					s := "<iq type='error' id='%v'><error code='401' type='auth'>" +
-						"<not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>" +
-						"</error></iq>"
-					c.write(fmt.Sprintf(s, id))
-					continue
-				}
-				c.JID = uc.Text + "@" + c.server.Config.Domain + "/" + rc.Text
-				c.logger.Debugf("JID set to %v", c.JID)
-				c.server.Lock()
-				for _, cl := range c.server.Clients {
-					// Intentionally BareJidMatch, we don't support multiple
-					// resources
-					if BareJidMatch(cl.JID, c.JID) {
-						cl.logger.Printf("Kicking client because of JID conflict")
-						cl.CloseError("<conflict xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>")
-					}
-				}
-				c.server.Unlock()
-				s := "<iq type='result' id='%v'/>"
-				c.write(fmt.Sprintf(s, id))
-				c.authenticated = true
-			}
-		} else {
-			c.logger.Debug("Received unknown IQ")
-			s := "<iq type='error' id='%v' from='%v'><error type='cancel'><service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
-			c.write(fmt.Sprintf(s, id, c.server.Config.Domain))
-		}
-	}
-}
-
 func (c *XmppClient) handlePresence(e xmlstream.Element) {
 	to := e.GetAttr("to")
 	typ := e.GetAttr("type")
 	if to != "" {
 		toBare := strings.Split(to, "/")[0]
 		if typ == "" {
-			c.logger.Debug("Handling presence as groupchat 1.0 join")
-			c.server.Lock()
-			var joinedRoom *XmppRoom
-			wasAdded := false
-			for _, room := range c.server.Rooms {
-				if strings.EqualFold(room.JID, toBare) {
-					c.logger.Debug("Added client to room " + toBare)
-					room.AddMember(c)
-					joinedRoom = room
-					wasAdded = true
-					break
-				}
-			}
-			if !wasAdded {
-				c.logger.Debug("Created room " + toBare)
-				joinedRoom = &XmppRoom{
-					JID:     toBare,
-					Members: []*XmppClient{c},
-				}
-				c.server.Rooms = append(c.server.Rooms, joinedRoom)
-			}
-			for _, member := range joinedRoom.Members {
-				str := "<presence from='%v' to='%v'>" +
-					"<x xmlns='http://jabber.org/protocol/muc#user'>" +
-					"<item affiliation='member' role='participant'/>"
-				if member == c {
-					str += "<status code='110'/>"
-				}
-				str += "</x></presence>"
-				nick := strings.Split(member.JID, "@")[0]
-				c.write(fmt.Sprintf(str, XMLEscape(toBare+"/"+nick), XMLEscape(c.JID)))
+			c.logger.Category(log.Routing).Debug("Handling presence as groupchat 1.0 join")
+			room := c.server.openRoom(toBare, c)
+			for !c.joinRoom(room, e) {
+				// The last occupant destroyed the room by leaving
+				room = c.server.openRoom(toBare, c)
 			}
-			for _, member := range joinedRoom.Members {
-				if member == c {
-					continue
-				}
-				str := "<presence from='%v' to='%v'>" +
-					"<x xmlns='http://jabber.org/protocol/muc#user'>" +
-					"<item affiliation='member' role='participant'/></x></presence>"
-				member.write(fmt.Sprintf(str, XMLEscape(to), XMLEscape(member.JID)))
-			}
-			c.server.Unlock()
 		}
 		if typ == "unavailable" {
-			c.logger.Debug("Handling presence as groupchat 1.0 leave")
-			c.server.Lock()
-			for _, room := range c.server.Rooms {
-				if room.JID == toBare {
-					room.RemoveMember(c)
-					c.logger.Debug("Removed client from room ", toBare)
-					break
-				}
+			c.logger.Category(log.Routing).Debug("Handling presence as groupchat 1.0 leave")
+			if room := c.server.rooms.get(toBare); room != nil {
+				c.server.leaveRoom(room, c, mucPresence{}, "")
 			}
-			c.server.Unlock()
 		}
 	} else {
-		c.logger.Debug("Adding client to available clients")
+		c.logger.Category(log.Routing).Debug("Adding client to available clients")
 		c.server.AddClient(c)
 	}
 }
 
 func (c *XmppClient) handleMessage(e xmlstream.Element) {
-	c.logger.Debugf("Handling message: %#v\n", e)
-	body, ok := e.GetChild("body")
-	if ok {
-		chatlog.ProcessMessage(body.Text)
-		if c.webhook.ProcessMessage(c.JID, body.Text) {
+	c.logger.Category(log.Routing).Debugf("Handling message: %#v\n", e)
+	user := strings.Split(c.JID, "@")[0]
+	mute, err := c.server.findMute(user, strings.Split(e.GetAttr("to"), "/")[0])
+	if err != nil {
+		c.logger.Category(log.Chat).Printf("error checking mutes: %v", err)
+	}
+	if mute != nil {
+		c.logger.Category(log.Chat).Event("message_muted").With(log.Fields{"to": e.GetAttr("to")}).
+			Print("Dropping message from muted user")
+		c.rejectMuted(e, mute)
+		return
+	}
+	groupchat := e.GetAttr("type") == "groupchat"
+	if groupchat && !c.hasVoice(e.GetAttr("to")) {
+		c.sendMessageError(e, ErrForbidden)
+		return
+	}
+	body, hasBody := e.GetChild("body")
+	var msg chatlog.Message
+	isChatMsg := false
+	if hasBody {
+		msg, isChatMsg = chatlog.ParseMessage(body.Text)
+	}
+	if isChatMsg {
+		metricChatMessages.With(msg.Type).Inc()
+		c.server.ChatLog.ProcessMessage(c.JID, e.GetAttr("to"), msg)
+		if c.webhook.ProcessMessage(c.JID, msg.Message) {
 			return
 		}
 	}
+	if subject, hasSubject := e.GetChild("subject"); groupchat && hasSubject && !hasBody {
+		c.changeSubject(e, subject.Text)
+		return
+	}
 	e.SetAttr("from", c.JID)
 	c.server.RouteMessage(e)
+	if isChatMsg && c.server.Events.Wants(events.Message) {
+		ev := c.event(events.Message)
+		ev.To = e.GetAttr("to")
+		if groupchat {
+			ev.Room = strings.Split(ev.To, "@")[0]
+		}
+		ev.Message = &msg
+		c.server.Events.Publish(ev)
+	}
 }
 
 func (c *XmppClient) write(str string) {
 	c.logger.Debugf("SEND: %v\n", str)
-	var err error
-	if c.tlsConn != nil {
-		_ = c.tlsConn.SetWriteDeadline(time.Now().Add(1 * time.Second))
-		_, err = c.tlsConn.Write([]byte(str))
-	} else {
-		_ = c.tcpConn.SetWriteDeadline(time.Now().Add(1 * time.Second))
-		_, err = c.tcpConn.Write([]byte(str))
-	}
-	if err != nil {
-		c.logger.Printf("failed to write: %v\n", err)
-		c.closeConn()
-	}
+	atomic.AddUint64(&c.stats.stanzasOut, 1)
+	c.enqueue(outbound{data: str})
+}
+
+// writeStanza queues a stanza routed to the client, which may be dropped
+// if the client doesn't keep up
+func (c *XmppClient) writeStanza(str string) {
+	c.logger.Debugf("SEND: %v\n", str)
+	atomic.AddUint64(&c.stats.stanzasOut, 1)
+	c.enqueue(outbound{data: str, droppable: true})
 }
 
 func (c *XmppClient) doTLS() error {
 	c.write("<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")
+	// <proceed/> has to be sent before switching to TLS
+	c.flush()
 	c.tlsConn = tls.Server(c.tcpConn, c.tlsConfig)
+	err := c.tlsConn.Handshake()
+	if err != nil {
+		version, cipher := c.tlsConn.NegotiatedParameters()
+		metricTLSHandshakeFailures.With(tlsVersionLabel(version), tlsCipherLabel(cipher)).Inc()
+		return fmt.Errorf("tls handshake failed: %v", err)
+	}
+	state := c.tlsConn.ConnectionState()
+	atomic.StoreUint32(&c.stats.tlsVersion, uint32(state.Version))
+	atomic.StoreUint32(&c.stats.tlsCipher, uint32(state.CipherSuite))
+	metricTLSHandshakes.With(tlsVersionLabel(state.Version), tlsCipherLabel(state.CipherSuite)).Inc()
+	return c.restartStream()
+}
+
+func (c *XmppClient) restartStream() error {
 	stream, err := xmlstream.NewStream(c.tlsConn)
 	if err != nil {
 		return fmt.Errorf("error creating xml stream: %v", err)
@@ -306,7 +318,7 @@ func (c *XmppClient) doTLS() error {
 
 func (c *XmppClient) sendStreamStart(toJid string) {
 	id := RandomStringSecure(10)
-	c.logger.SetPrefix("[" + id + "] ")
+	c.logger.SetField(log.FieldStreamID, id)
 	t := xml.Header + "<stream:stream " +
 		"from='%v' " +
 		"id='%v' " +
@@ -314,7 +326,7 @@ func (c *XmppClient) sendStreamStart(toJid string) {
 		"xml:lang='en' " +
 		"xmlns='jabber:client' " +
 		"xmlns:stream='http://etherx.jabber.org/streams'>"
-	c.write(fmt.Sprintf(t, c.server.Config.Domain, id))
+	c.write(fmt.Sprintf(t, c.server.Config.Get().Domain, id))
 }
 
 func (c *XmppClient) sendPreTLSStreamFeatures() {
@@ -326,15 +338,27 @@ func (c *XmppClient) sendPreTLSStreamFeatures() {
 
 func (c *XmppClient) sendPostTLSStreamFeatures() {
 	t := "<stream:features>" +
+		"<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>" +
+		"<mechanism>PLAIN</mechanism>" +
+		"<mechanism>SCRAM-SHA-1</mechanism>" +
+		"</mechanisms>" +
 		"<auth xmlns='http://jabber.org/features/iq-auth'/>" +
 		"</stream:features>"
 	c.write(t)
 }
 
+func (c *XmppClient) sendPostSASLStreamFeatures() {
+	t := "<stream:features>" +
+		"<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>" +
+		"<session xmlns='urn:ietf:params:xml:ns:xmpp-session'><optional/></session>" +
+		"</stream:features>"
+	c.write(t)
+}
+
 func (c *XmppClient) Write(m string) {
 	c.write(m)
 }
 
 func (c *XmppClient) SendXML(e xmlstream.Element) {
-	c.write(e.AsString())
+	c.writeStanza(e.AsString())
 }
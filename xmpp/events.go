@@ -0,0 +1,44 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"strings"
+
+	"github.com/redbluescreen/sbrwxmpp/events"
+	"github.com/redbluescreen/sbrwxmpp/log"
+)
+
+// event returns an event of type t about the client
+func (c *XmppClient) event(t events.Type) events.Event {
+	return events.Event{
+		Type: t,
+		JID:  c.JID,
+		User: strings.Split(c.JID, "@")[0],
+		IP:   c.RemoteIP(),
+	}
+}
+
+// roomEvent returns an event of type t about the client and a room
+func (c *XmppClient) roomEvent(t events.Type, room *XmppRoom) events.Event {
+	e := c.event(t)
+	e.Room = strings.Split(room.JID, "@")[0]
+	return e
+}
+
+// newRoomEvent returns an event of type t about a room
+func newRoomEvent(t events.Type, room *XmppRoom) events.Event {
+	return events.Event{Type: t, Room: strings.Split(room.JID, "@")[0]}
+}
+
+// Kick closes the stream of the client with streamError
+func (c *XmppClient) Kick(reason, streamError string) {
+	c.logger.Category(log.Auth).Event("kick").With(log.Fields{"reason": reason}).
+		Print("Kicking client")
+	e := c.event(events.Kick)
+	e.Reason = reason
+	c.server.Events.Publish(e)
+	c.CloseError(streamError)
+}
@@ -0,0 +1,181 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	xmlstream "github.com/redbluescreen/sbrwxmpp/xmlstream2"
+)
+
+const (
+	nsMUC   = "http://jabber.org/protocol/muc"
+	nsDelay = "urn:xmpp:delay"
+
+	defaultHistorySize = 20
+	// XEP-0082 DateTime profile
+	delayStampFormat = "2006-01-02T15:04:05.000Z"
+)
+
+type historyEntry struct {
+	msg   xmlstream.Element
+	stamp time.Time
+}
+
+// roomHistory keeps the latest groupchat messages of a room
+type roomHistory struct {
+	mu         sync.Mutex
+	entries    []historyEntry
+	maxStanzas int
+	maxAge     time.Duration
+}
+
+// setLimits changes the limits of the history and drops messages that
+// exceed them
+func (h *roomHistory) setLimits(maxStanzas int, maxAge time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.maxStanzas = maxStanzas
+	h.maxAge = maxAge
+	h.prune(time.Now())
+}
+
+// add stores a message. The element must not be modified afterwards.
+func (h *roomHistory) add(msg xmlstream.Element, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.maxStanzas <= 0 {
+		return
+	}
+	h.entries = append(h.entries, historyEntry{msg: msg, stamp: now})
+	h.prune(now)
+}
+
+// prune must be called with the history locked
+func (h *roomHistory) prune(now time.Time) {
+	drop := 0
+	if h.maxStanzas <= 0 {
+		drop = len(h.entries)
+	} else if len(h.entries) > h.maxStanzas {
+		drop = len(h.entries) - h.maxStanzas
+	}
+	if h.maxAge > 0 {
+		for drop < len(h.entries) && now.Sub(h.entries[drop].stamp) > h.maxAge {
+			drop++
+		}
+	}
+	if drop > 0 {
+		// Copy so the backing array doesn't keep dropped messages
+		h.entries = append([]historyEntry(nil), h.entries[drop:]...)
+	}
+}
+
+// historyRequest is the <history/> element of a MUC join. Negative
+// values mean no limit.
+type historyRequest struct {
+	maxStanzas int
+	maxChars   int
+	seconds    int
+	since      time.Time
+}
+
+func parseHistoryRequest(presence xmlstream.Element) historyRequest {
+	req := historyRequest{maxStanzas: -1, maxChars: -1, seconds: -1}
+	x, ok := presence.GetChild("x")
+	if !ok || x.Name.Space != nsMUC {
+		return req
+	}
+	h, ok := x.GetChild("history")
+	if !ok {
+		return req
+	}
+	if n, err := strconv.Atoi(h.GetAttr("maxstanzas")); err == nil && n >= 0 {
+		req.maxStanzas = n
+	}
+	if n, err := strconv.Atoi(h.GetAttr("maxchars")); err == nil && n >= 0 {
+		req.maxChars = n
+	}
+	if n, err := strconv.Atoi(h.GetAttr("seconds")); err == nil && n >= 0 {
+		req.seconds = n
+	}
+	if t, err := time.Parse(time.RFC3339, h.GetAttr("since")); err == nil {
+		req.since = t
+	}
+	return req
+}
+
+// get returns the stored messages matching req, oldest first
+func (h *roomHistory) get(req historyRequest, now time.Time) []historyEntry {
+	h.mu.Lock()
+	h.prune(now)
+	entries := h.entries
+	h.mu.Unlock()
+
+	chars := 0
+	first := len(entries)
+	for first > 0 {
+		e := entries[first-1]
+		if req.maxStanzas >= 0 && len(entries)-first >= req.maxStanzas {
+			break
+		}
+		if req.seconds >= 0 && now.Sub(e.stamp) > time.Duration(req.seconds)*time.Second {
+			break
+		}
+		if !req.since.IsZero() && !e.stamp.After(req.since) {
+			break
+		}
+		if req.maxChars >= 0 {
+			chars += len(e.msg.AsString())
+			if chars > req.maxChars {
+				break
+			}
+		}
+		first--
+	}
+	return entries[first:]
+}
+
+// historyLimits returns the configured history limits of a room
+func (s *XmppServer) historyLimits(room string) (int, time.Duration) {
+	cfg := s.Config.Get().History
+	maxStanzas, maxAge := cfg.MaxStanzas, cfg.MaxAge
+	room = strings.ToLower(room)
+	for _, r := range cfg.Rooms {
+		if ok, _ := path.Match(strings.ToLower(r.Pattern), room); !ok {
+			continue
+		}
+		if r.MaxStanzas != 0 {
+			maxStanzas = r.MaxStanzas
+		}
+		if r.MaxAge != 0 {
+			maxAge = r.MaxAge
+		}
+		break
+	}
+	if maxStanzas == 0 {
+		maxStanzas = defaultHistorySize
+	}
+	return maxStanzas, time.Duration(maxAge) * time.Second
+}
+
+// sendHistory sends the stored messages of a room with XEP-0203 delay
+// stamps
+func (c *XmppClient) sendHistory(room *XmppRoom, req historyRequest) {
+	for _, e := range room.history.get(req, time.Now()) {
+		msg := e.msg
+		msg.Attr = append([]xml.Attr(nil), msg.Attr...)
+		msg.SetAttr("to", c.JID)
+		delay := xmlstream.Element{Name: xml.Name{Space: nsDelay, Local: "delay"}}
+		delay.SetAttr("from", room.JID)
+		delay.SetAttr("stamp", e.stamp.UTC().Format(delayStampFormat))
+		msg.Children = append(append([]xmlstream.Element(nil), msg.Children...), delay)
+		c.SendXML(msg)
+	}
+}
@@ -0,0 +1,69 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/redbluescreen/sbrwxmpp/config"
+	xmlstream "github.com/redbluescreen/sbrwxmpp/xmlstream2"
+)
+
+func historyMessage(id string) xmlstream.Element {
+	msg := xmlstream.Element{Name: xml.Name{Local: "message"}}
+	msg.SetAttr("id", id)
+	return msg
+}
+
+func TestRoomHistory(t *testing.T) {
+	var h roomHistory
+	h.setLimits(3, time.Hour)
+	now := time.Now()
+	h.add(historyMessage("old"), now.Add(-2*time.Hour))
+	for i, id := range []string{"a", "b", "c", "d"} {
+		h.add(historyMessage(id), now.Add(time.Duration(i-4)*time.Minute))
+	}
+	ids := func(entries []historyEntry) (s string) {
+		for _, e := range entries {
+			s += e.msg.GetAttr("id")
+		}
+		return s
+	}
+	all := historyRequest{maxStanzas: -1, maxChars: -1, seconds: -1}
+	if got := ids(h.get(all, now)); got != "bcd" {
+		t.Errorf("got %q, want bcd", got)
+	}
+	if got := ids(h.get(historyRequest{maxStanzas: 1, maxChars: -1, seconds: -1}, now)); got != "d" {
+		t.Errorf("maxstanzas: got %q, want d", got)
+	}
+	if got := ids(h.get(historyRequest{maxStanzas: -1, maxChars: -1, seconds: 150}, now)); got != "cd" {
+		t.Errorf("seconds: got %q, want cd", got)
+	}
+	if got := ids(h.get(historyRequest{maxStanzas: -1, maxChars: 0, seconds: -1}, now)); got != "" {
+		t.Errorf("maxchars: got %q, want nothing", got)
+	}
+	h.setLimits(-1, 0)
+	if got := ids(h.get(all, now)); got != "" {
+		t.Errorf("disabled history: got %q, want nothing", got)
+	}
+}
+
+func TestHistoryLimits(t *testing.T) {
+	s := &XmppServer{Config: config.NewStore(&config.Config{History: config.HistoryConfig{
+		MaxAge: 60,
+		Rooms: []config.RoomHistoryConfig{
+			{Pattern: "group.*@conference.*", MaxStanzas: 50},
+			{Pattern: "*", MaxStanzas: -1},
+		},
+	}})}
+	if n, age := s.historyLimits("Group.1@conference.localhost"); n != 50 || age != time.Minute {
+		t.Errorf("group room: got %v, %v", n, age)
+	}
+	if n, _ := s.historyLimits("channel.en__1@conference.localhost"); n != -1 {
+		t.Errorf("other room: got %v, want disabled", n)
+	}
+}
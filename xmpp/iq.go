@@ -0,0 +1,126 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+	"sync"
+
+	"github.com/redbluescreen/sbrwxmpp/log"
+	xmlstream "github.com/redbluescreen/sbrwxmpp/xmlstream2"
+)
+
+// Iq is a get or set IQ received from a client.
+type Iq struct {
+	ID      string
+	Type    string
+	To      string
+	Payload xmlstream.Element
+}
+
+// IqHandlerFunc handles an IQ request. It returns the inner XML of the
+// result IQ (empty for no payload) or an error. StanzaErrors are sent
+// to the client as is, any other error results in internal-server-error.
+type IqHandlerFunc func(c *XmppClient, iq Iq) (string, error)
+
+type IqHandler struct {
+	Get IqHandlerFunc
+	Set IqHandlerFunc
+	// Unauthenticated allows the handler to be used before the client
+	// has authenticated
+	Unauthenticated bool
+}
+
+// IqRegistry maps IQ payloads (namespace and element name) to handlers.
+type IqRegistry struct {
+	sync.RWMutex
+	handlers map[xml.Name]IqHandler
+}
+
+func NewIqRegistry() *IqRegistry {
+	return &IqRegistry{
+		handlers: make(map[xml.Name]IqHandler),
+	}
+}
+
+func (r *IqRegistry) Register(space, local string, h IqHandler) {
+	r.Lock()
+	defer r.Unlock()
+	r.handlers[xml.Name{Space: space, Local: local}] = h
+}
+
+func (r *IqRegistry) Lookup(name xml.Name) (IqHandler, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	h, ok := r.handlers[name]
+	return h, ok
+}
+
+func (c *XmppClient) handleIq(e xmlstream.Element) {
+	id := e.GetAttr("id")
+	typ := e.GetAttr("type")
+	to := e.GetAttr("to")
+	if typ == "result" || typ == "error" {
+		c.logger.Debug("Ignoring IQ response")
+		return
+	}
+	if id == "" || (typ != "get" && typ != "set") || len(e.Children) != 1 {
+		c.logger.Println("iq error: id, type or payload invalid")
+		c.sendIqError(id, to, ErrBadRequest)
+		return
+	}
+	payload := e.Children[0]
+	h, ok := c.server.IqHandlers.Lookup(payload.Name)
+	fn := h.Get
+	if typ == "set" {
+		fn = h.Set
+	}
+	if !ok || fn == nil {
+		c.logger.With(log.Fields{"namespace": payload.Name.Space, "element": payload.Name.Local}).
+			Debug("Received unknown IQ")
+		c.sendIqError(id, to, ErrServiceUnavailable)
+		return
+	}
+	if !c.authenticated && !h.Unauthenticated {
+		c.sendIqError(id, to, ErrNotAuthorized)
+		return
+	}
+	result, err := fn(c, Iq{
+		ID:      id,
+		Type:    typ,
+		To:      to,
+		Payload: payload,
+	})
+	if err != nil {
+		serr, ok := err.(StanzaError)
+		if !ok {
+			c.logger.Printf("error handling iq: %v", err)
+			serr = ErrInternalServerError
+		}
+		c.sendIqError(id, to, serr)
+		return
+	}
+	if result == "" {
+		c.write(strings.TrimSuffix(iqStart("result", id, to), ">") + "/>")
+		return
+	}
+	c.write(iqStart("result", id, to) + result + "</iq>")
+}
+
+func (c *XmppClient) sendIqError(id, from string, err StanzaError) {
+	c.write(iqStart("error", id, from) + err.XML() + "</iq>")
+}
+
+func iqStart(typ, id, from string) string {
+	s := "<iq type='" + typ + "'"
+	if id != "" {
+		s += " id='" + XMLEscape(id) + "'"
+	}
+	if from != "" {
+		s += " from='" + XMLEscape(from) + "'"
+	}
+	return s + ">"
+}
@@ -0,0 +1,51 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"github.com/redbluescreen/sbrwxmpp/metrics"
+	"github.com/redbluescreen/sbrwxmpp/tls"
+)
+
+var (
+	metricConnectedClients = metrics.NewGauge("sbrwxmpp_connected_clients",
+		"Number of open client connections.")
+	metricSessions = metrics.NewGauge("sbrwxmpp_authenticated_sessions",
+		"Number of authenticated sessions.")
+	metricRooms = metrics.NewGauge("sbrwxmpp_rooms",
+		"Number of rooms.")
+	metricRoomMembers = metrics.NewGaugeVec("sbrwxmpp_room_members",
+		"Number of members per room.", "room")
+	metricMessagesRouted = metrics.NewCounterVec("sbrwxmpp_messages_routed_total",
+		"Messages routed, by stanza type.", "type")
+	metricChatMessages = metrics.NewCounterVec("sbrwxmpp_chat_messages_total",
+		"ChatMsg messages received, by ChatMsg type.", "type")
+	metricAuthFailures = metrics.NewCounterVec("sbrwxmpp_auth_failures_total",
+		"Failed authentication attempts, by mechanism.", "mechanism")
+	metricTLSHandshakes = metrics.NewCounterVec("sbrwxmpp_tls_handshakes_total",
+		"Successful TLS handshakes, by version and cipher suite.", "version", "cipher")
+	metricTLSHandshakeFailures = metrics.NewCounterVec("sbrwxmpp_tls_handshake_failures_total",
+		"Failed TLS handshakes, by negotiated version and cipher suite.", "version", "cipher")
+	metricQueueDropped = metrics.NewCounter("sbrwxmpp_send_queue_dropped_total",
+		"Stanzas dropped because a client's send queue was full.")
+	metricQueueOverflows = metrics.NewCounter("sbrwxmpp_send_queue_overflows_total",
+		"Clients disconnected because their send queue was full.")
+	metricWriteTimeouts = metrics.NewCounter("sbrwxmpp_write_timeouts_total",
+		"Writes to clients that timed out.")
+)
+
+func tlsVersionLabel(version uint16) string {
+	if version == 0 {
+		return "unknown"
+	}
+	return tls.VersionName(version)
+}
+
+func tlsCipherLabel(cipher uint16) string {
+	if cipher == 0 {
+		return "unknown"
+	}
+	return tls.CipherSuiteName(cipher)
+}
@@ -0,0 +1,276 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redbluescreen/sbrwxmpp/db"
+	"github.com/redbluescreen/sbrwxmpp/events"
+	"github.com/redbluescreen/sbrwxmpp/log"
+	xmlstream "github.com/redbluescreen/sbrwxmpp/xmlstream2"
+)
+
+// Subject returns the subject of the room and the nick that set it
+func (r *XmppRoom) Subject() (subject, by string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.subject, r.subjectBy
+}
+
+// SetSubject changes the subject and sends it to all members. by is the
+// nick of the occupant that set it, empty for the room itself.
+func (r *XmppRoom) SetSubject(subject, by string) {
+	r.mu.Lock()
+	r.subject = subject
+	r.subjectBy = by
+	r.mu.Unlock()
+	for _, member := range r.Members() {
+		member.writeStanza(r.subjectMessage(member.JID, subject, by))
+	}
+}
+
+func (r *XmppRoom) subjectMessage(to, subject, by string) string {
+	from := r.JID
+	if by != "" {
+		from += "/" + by
+	}
+	if subject == "" {
+		return fmt.Sprintf("<message from='%v' to='%v' type='groupchat'><subject/></message>",
+			XMLEscape(from), XMLEscape(to))
+	}
+	return fmt.Sprintf("<message from='%v' to='%v' type='groupchat'><subject>%v</subject></message>",
+		XMLEscape(from), XMLEscape(to), XMLEscape(subject))
+}
+
+// sendSubject sends the room subject to a client that joined. Clients
+// using the old groupchat protocol only get non-empty subjects.
+func (c *XmppClient) sendSubject(room *XmppRoom, mucAware bool) {
+	subject, by := room.Subject()
+	if subject != "" || mucAware {
+		c.write(room.subjectMessage(c.JID, subject, by))
+	}
+}
+
+// isMUCJoin returns whether a presence carries the MUC <x/> element
+func isMUCJoin(presence xmlstream.Element) bool {
+	x, ok := presence.GetChild("x")
+	return ok && x.Name.Space == nsMUC
+}
+
+// SetRoomSubject changes the subject of a room. It is stored if persist
+// is set or the room has been stored before. It returns false if the
+// room neither exists nor is stored.
+func (s *XmppServer) SetRoomSubject(jid, subject, by string, persist bool) (bool, error) {
+	found := false
+	if !persist {
+		stored, err := s.DB.GetRoom(jid)
+		if err != nil {
+			return false, err
+		}
+		persist = stored != nil
+	}
+	if persist {
+		err := s.DB.UpdateRoom(jid, func(r *db.Room) error {
+			r.Subject = subject
+			r.SubjectBy = by
+			r.SubjectAt = time.Now()
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+		found = true
+	}
+	if room := s.rooms.get(jid); room != nil {
+		if persist && room.setStored() {
+			err := s.storeRoom(room)
+			if err != nil {
+				return false, err
+			}
+		}
+		room.SetSubject(subject, by)
+		found = true
+	}
+	return found, nil
+}
+
+// isStaff returns whether a user has admin rights on the server
+func (s *XmppServer) isStaff(name string) bool {
+	user, err := s.DB.GetUser(name)
+	if err != nil {
+		s.Logger.Category(log.Auth).Printf("error getting user: %v", err)
+		return false
+	}
+	return user != nil && user.Flags.Has(db.UserAdmin)
+}
+
+// changeSubject handles a groupchat message with a <subject/> and no body
+func (c *XmppClient) changeSubject(e xmlstream.Element, subject string) {
+	roomJID := strings.Split(e.GetAttr("to"), "/")[0]
+	room := c.server.rooms.get(roomJID)
+	if room == nil {
+		c.sendMessageError(e, ErrNotAcceptable)
+		return
+	}
+	o := room.Occupant(c)
+	if o == nil {
+		c.sendMessageError(e, ErrNotAcceptable)
+		return
+	}
+	if o.Role != RoleModerator {
+		c.sendMessageError(e, ErrForbidden)
+		return
+	}
+	_, err := c.server.SetRoomSubject(room.JID, subject, o.Nick, false)
+	if err != nil {
+		c.logger.Category(log.Routing).Printf("error storing subject: %v", err)
+	}
+}
+
+// affiliation returns the affiliation of a bare JID in a room. Staff
+// are at least admins of every room.
+func (s *XmppServer) affiliation(room *XmppRoom, bare string) string {
+	affiliation := room.Affiliation(bare)
+	if affiliationRank(affiliation) < affiliationRank(AffiliationAdmin) &&
+		s.isStaff(strings.Split(bare, "@")[0]) {
+		return AffiliationAdmin
+	}
+	return affiliation
+}
+
+// joinRoom adds the client to a room and sends it the occupants, the
+// history and the subject. The nick is the resource of the presence's
+// to, defaulting to the local part of the client's JID. Repeated
+// presences change the nick or only update the other occupants. It
+// returns false if the room was destroyed before the client could join.
+func (c *XmppClient) joinRoom(room *XmppRoom, e xmlstream.Element) bool {
+	nick := ""
+	if parts := strings.SplitN(e.GetAttr("to"), "/", 2); len(parts) == 2 {
+		nick = strings.TrimSpace(parts[1])
+	}
+	if o := room.Occupant(c); o != nil {
+		if nick != "" && nick != o.Nick {
+			c.changeNick(room, o, nick, e)
+		} else {
+			room.broadcastPresence(o, "")
+		}
+		return true
+	}
+	if nick == "" {
+		nick = strings.Split(c.JID, "@")[0]
+	}
+	bare := strings.Split(c.JID, "/")[0]
+	affiliation := c.server.affiliation(room, bare)
+	if serr, ok := checkJoin(room, affiliation, e); !ok {
+		c.logger.Category(log.Routing).With(log.Fields{"room": room.JID, "error": serr.Condition}).
+			Debug("Rejecting room join")
+		c.sendPresenceError(e, serr)
+		c.server.destroyIfEmpty(room)
+		return true
+	}
+	o := &Occupant{
+		Client:      c,
+		Nick:        nick,
+		Affiliation: affiliation,
+		Role:        room.roleFor(bare, affiliation),
+	}
+	switch room.addOccupant(o) {
+	case nil:
+	case errDestroyed:
+		return false
+	case errNickInUse:
+		c.sendPresenceError(e, ErrConflict)
+		c.server.destroyIfEmpty(room)
+		return true
+	default:
+		return true
+	}
+	c.logger.Category(log.Routing).With(log.Fields{"room": room.JID, "nick": nick}).Debug("Added client to room")
+	c.server.Events.Publish(c.roomEvent(events.RoomJoin, room))
+	for _, other := range room.Occupants() {
+		if other != o {
+			c.writeStanza(room.occupantPresence(other, c, mucPresence{}))
+			other.Client.writeStanza(room.occupantPresence(o, other.Client, mucPresence{}))
+		}
+	}
+	c.write(room.occupantPresence(o, c, mucPresence{}))
+	room.history.setLimits(c.server.roomHistoryLimits(room))
+	c.sendHistory(room, parseHistoryRequest(e))
+	c.sendSubject(room, isMUCJoin(e))
+	return true
+}
+
+// checkJoin returns whether a client with the affiliation may join the
+// room, and the error to reject it with if not. Admins and owners can
+// always join unless they are banned.
+func checkJoin(room *XmppRoom, affiliation string, e xmlstream.Element) (StanzaError, bool) {
+	if affiliation == AffiliationOutcast {
+		return ErrForbidden, false
+	}
+	if affiliationRank(affiliation) >= affiliationRank(AffiliationAdmin) {
+		return StanzaError{}, true
+	}
+	options := room.Options()
+	if options.MembersOnly && affiliationRank(affiliation) < affiliationRank(AffiliationMember) {
+		return ErrRegistrationRequired, false
+	}
+	if options.Password != "" {
+		password := ""
+		if x, ok := e.GetChild("x"); ok && x.Name.Space == nsMUC {
+			if p, ok := x.GetChild("password"); ok {
+				password = p.Text
+			}
+		}
+		if subtle.ConstantTimeCompare([]byte(password), []byte(options.Password)) != 1 {
+			return ErrNotAuthorized, false
+		}
+	}
+	if options.MaxOccupants > 0 && len(room.Occupants()) >= options.MaxOccupants {
+		return ErrServiceUnavailable, false
+	}
+	return StanzaError{}, true
+}
+
+// changeNick changes the nick of an occupant and tells all occupants
+func (c *XmppClient) changeNick(room *XmppRoom, o *Occupant, nick string, e xmlstream.Element) {
+	updated := room.changeNick(o, nick)
+	if updated == nil {
+		c.sendPresenceError(e, ErrConflict)
+		return
+	}
+	c.logger.Category(log.Routing).With(log.Fields{"room": room.JID, "nick": nick}).Debug("Changed nick")
+	unavailable := mucPresence{unavailable: true, newNick: nick, codes: []int{statusNewNick}}
+	for _, member := range room.Members() {
+		member.writeStanza(room.occupantPresence(o, member, unavailable))
+		member.writeStanza(room.occupantPresence(updated, member, mucPresence{}))
+	}
+}
+
+// sendPresenceError bounces a presence sent to a room
+func (c *XmppClient) sendPresenceError(e xmlstream.Element, serr StanzaError) {
+	s := "<presence from='%v' to='%v' type='error'><x xmlns='%v'/>%v</presence>"
+	c.write(fmt.Sprintf(s, XMLEscape(e.GetAttr("to")), XMLEscape(c.JID), nsMUC, serr.XML()))
+}
+
+// hasVoice returns false if the client is a visitor of the room it sends
+// a groupchat message to
+func (c *XmppClient) hasVoice(to string) bool {
+	room := c.server.rooms.get(strings.Split(to, "/")[0])
+	if room == nil {
+		return true
+	}
+	o := room.Occupant(c)
+	return o == nil || o.Role != RoleVisitor
+}
+
+// sendMessageError bounces a message with a stanza error
+func (c *XmppClient) sendMessageError(e xmlstream.Element, serr StanzaError) {
+	s := "<message type='error' id='%v' from='%v' to='%v'>%v</message>"
+	c.write(fmt.Sprintf(s, XMLEscape(e.GetAttr("id")), XMLEscape(e.GetAttr("to")), XMLEscape(c.JID), serr.XML()))
+}
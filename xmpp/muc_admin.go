@@ -0,0 +1,278 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/redbluescreen/sbrwxmpp/db"
+	"github.com/redbluescreen/sbrwxmpp/log"
+	xmlstream "github.com/redbluescreen/sbrwxmpp/xmlstream2"
+)
+
+const nsMUCAdmin = "http://jabber.org/protocol/muc#admin"
+
+// mucAdminHandler implements the XEP-0045 admin use cases: kicking,
+// banning, granting and revoking voice and listing roles and
+// affiliations
+var mucAdminHandler = IqHandler{
+	Get: mucAdminGet,
+	Set: mucAdminSet,
+}
+
+// mucAdminItems returns the <item/> children of an admin query
+func mucAdminItems(iq Iq) ([]xmlstream.Element, error) {
+	var items []xmlstream.Element
+	for _, child := range iq.Payload.Children {
+		if child.Name.Local == "item" {
+			items = append(items, child)
+		}
+	}
+	if len(items) == 0 {
+		return nil, ErrBadRequest
+	}
+	return items, nil
+}
+
+func mucAdminGet(c *XmppClient, iq Iq) (string, error) {
+	room := c.server.rooms.get(strings.Split(iq.To, "/")[0])
+	if room == nil {
+		return "", ErrItemNotFound
+	}
+	items, err := mucAdminItems(iq)
+	if err != nil {
+		return "", err
+	}
+	bare := strings.Split(c.JID, "/")[0]
+	result := "<query xmlns='" + nsMUCAdmin + "'>"
+	for _, item := range items {
+		if affiliation := item.GetAttr("affiliation"); affiliation != "" {
+			if affiliationRank(c.server.affiliation(room, bare)) < affiliationRank(AffiliationAdmin) {
+				return "", ErrForbidden
+			}
+			for jid, a := range room.Affiliations() {
+				if a == affiliation {
+					result += fmt.Sprintf("<item affiliation='%v' jid='%v'/>", XMLEscape(a), XMLEscape(jid))
+				}
+			}
+		} else if role := item.GetAttr("role"); role != "" {
+			if o := room.Occupant(c); o == nil || o.Role != RoleModerator {
+				return "", ErrForbidden
+			}
+			for _, o := range room.Occupants() {
+				if o.Role == role {
+					result += fmt.Sprintf("<item affiliation='%v' role='%v' nick='%v' jid='%v'/>",
+						o.Affiliation, o.Role, XMLEscape(o.Nick), XMLEscape(o.Client.JID))
+				}
+			}
+		} else {
+			return "", ErrBadRequest
+		}
+	}
+	return result + "</query>", nil
+}
+
+// mucChange is a validated item of an admin set request
+type mucChange struct {
+	target      *Occupant
+	bare        string
+	role        string
+	affiliation string
+	reason      string
+}
+
+func mucAdminSet(c *XmppClient, iq Iq) (string, error) {
+	room := c.server.rooms.get(strings.Split(iq.To, "/")[0])
+	if room == nil {
+		return "", ErrItemNotFound
+	}
+	items, err := mucAdminItems(iq)
+	if err != nil {
+		return "", err
+	}
+	// Check all items before applying any of them
+	changes := make([]mucChange, len(items))
+	for i, item := range items {
+		changes[i], err = c.checkMUCChange(room, item)
+		if err != nil {
+			return "", err
+		}
+	}
+	for _, change := range changes {
+		if change.affiliation != "" {
+			err = c.server.changeAffiliation(room, change.bare, change.affiliation, change.reason)
+		} else {
+			err = c.server.changeRole(room, change.target, change.role, change.reason)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// checkMUCChange validates an item of an admin set request against the
+// privileges of c
+func (c *XmppClient) checkMUCChange(room *XmppRoom, item xmlstream.Element) (mucChange, error) {
+	change := mucChange{
+		role:        item.GetAttr("role"),
+		affiliation: item.GetAttr("affiliation"),
+	}
+	if reason, ok := item.GetChild("reason"); ok {
+		change.reason = reason.Text
+	}
+	if nick := item.GetAttr("nick"); nick != "" {
+		change.target = room.OccupantByNick(nick)
+		if change.target == nil {
+			return change, ErrItemNotFound
+		}
+		change.bare = strings.Split(change.target.Client.JID, "/")[0]
+	} else if jid := item.GetAttr("jid"); jid != "" && change.affiliation != "" {
+		change.bare = strings.Split(jid, "/")[0]
+	} else {
+		return change, ErrBadRequest
+	}
+	actor := room.Occupant(c)
+	actorAffiliation := c.server.affiliation(room, strings.Split(c.JID, "/")[0])
+
+	if change.affiliation != "" {
+		if affiliationRank(change.affiliation) == 0 {
+			return change, ErrBadRequest
+		}
+		if affiliationRank(actorAffiliation) < affiliationRank(AffiliationAdmin) {
+			return change, ErrForbidden
+		}
+		current := c.server.affiliation(room, change.bare)
+		// Only owners can change admins and owners
+		if actorAffiliation != AffiliationOwner &&
+			(affiliationRank(change.affiliation) >= affiliationRank(AffiliationAdmin) ||
+				affiliationRank(current) >= affiliationRank(AffiliationAdmin)) {
+			return change, ErrNotAllowed
+		}
+		return change, nil
+	}
+
+	if !validRole(change.role) || change.target == nil {
+		return change, ErrBadRequest
+	}
+	if actor == nil || actor.Role != RoleModerator {
+		return change, ErrForbidden
+	}
+	// Admins and owners are always moderators
+	if affiliationRank(change.target.Affiliation) >= affiliationRank(AffiliationAdmin) &&
+		change.role != RoleModerator {
+		return change, ErrNotAllowed
+	}
+	if (change.role == RoleModerator || change.target.Role == RoleModerator) &&
+		affiliationRank(actorAffiliation) < affiliationRank(AffiliationAdmin) {
+		return change, ErrNotAllowed
+	}
+	return change, nil
+}
+
+// changeRole changes the role of an occupant. Changing it to none kicks
+// the occupant.
+func (s *XmppServer) changeRole(room *XmppRoom, o *Occupant, role, reason string) error {
+	logger := s.Logger.Category(log.Routing).With(log.Fields{"room": room.JID, "jid": o.Client.JID})
+	if role == RoleNone {
+		p := mucPresence{reason: reason, codes: []int{statusKicked}}
+		if s.leaveRoom(room, o.Client, p, "kicked") {
+			logger.Event("room_kick").Print("Kicked occupant from room")
+		}
+		return nil
+	}
+	updated := *o
+	updated.Role = role
+	if !room.replaceOccupant(o, &updated) {
+		return nil
+	}
+	logger.With(log.Fields{"role": role}).Print("Changed occupant role")
+	if room.setRoleOverride(strings.Split(o.Client.JID, "/")[0], role) {
+		err := s.storeRoom(room)
+		if err != nil {
+			return err
+		}
+	}
+	room.broadcastPresence(&updated, reason)
+	return nil
+}
+
+// changeAffiliation changes the affiliation of a bare JID in a room and
+// updates its occupants. Outcasts are removed from the room.
+func (s *XmppServer) changeAffiliation(room *XmppRoom, bare, affiliation, reason string) error {
+	s.Logger.Category(log.Routing).With(log.Fields{"room": room.JID, "jid": bare, "affiliation": affiliation}).
+		Print("Changed affiliation")
+	if room.setAffiliation(bare, affiliation) {
+		err := s.storeRoom(room)
+		if err != nil {
+			return err
+		}
+	}
+	for _, o := range room.Occupants() {
+		if !BareJidMatch(o.Client.JID, bare) {
+			continue
+		}
+		if affiliation == AffiliationOutcast {
+			p := mucPresence{reason: reason, codes: []int{statusBanned}}
+			s.leaveRoom(room, o.Client, p, "banned")
+			continue
+		}
+		updated := *o
+		updated.Affiliation = s.affiliation(room, bare)
+		updated.Role = room.roleFor(bare, updated.Affiliation)
+		if room.replaceOccupant(o, &updated) {
+			room.broadcastPresence(&updated, reason)
+		}
+	}
+	return nil
+}
+
+// SetAffiliation changes the affiliation of a bare JID in a room. The
+// room is stored if persist is set or it has been stored before. It
+// returns false if the room neither exists nor is stored.
+func (s *XmppServer) SetAffiliation(roomJID, bare, affiliation string, persist bool) (bool, error) {
+	if affiliationRank(affiliation) == 0 {
+		return false, fmt.Errorf("invalid affiliation %q", affiliation)
+	}
+	if room := s.rooms.get(roomJID); room != nil {
+		if persist {
+			room.setStored()
+		}
+		return true, s.changeAffiliation(room, bare, affiliation, "")
+	}
+	stored, err := s.DB.GetRoom(roomJID)
+	if err != nil || (stored == nil && !persist) {
+		return false, err
+	}
+	return true, s.DB.UpdateRoom(roomJID, func(r *db.Room) error {
+		bare = strings.ToLower(bare)
+		if affiliation == AffiliationNone {
+			delete(r.Affiliations, bare)
+			return nil
+		}
+		if r.Affiliations == nil {
+			r.Affiliations = make(map[string]string)
+		}
+		r.Affiliations[bare] = affiliation
+		return nil
+	})
+}
+
+// RoomAffiliations returns the affiliations of a live or stored room. It
+// returns false if the room neither exists nor is stored.
+func (s *XmppServer) RoomAffiliations(roomJID string) (map[string]string, bool, error) {
+	if room := s.rooms.get(roomJID); room != nil {
+		return room.Affiliations(), true, nil
+	}
+	stored, err := s.DB.GetRoom(roomJID)
+	if err != nil || stored == nil {
+		return nil, false, err
+	}
+	if stored.Affiliations == nil {
+		return map[string]string{}, true, nil
+	}
+	return stored.Affiliations, true, nil
+}
@@ -0,0 +1,139 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/redbluescreen/sbrwxmpp/db"
+	xmlstream "github.com/redbluescreen/sbrwxmpp/xmlstream2"
+)
+
+// newAdminTestRoom returns a room whose occupants are named after their
+// affiliation or role, and a client named outsider that isn't in it
+func newAdminTestRoom(t *testing.T) (*XmppRoom, map[string]*XmppClient, func()) {
+	dir, err := ioutil.TempDir("", "sbrwxmpp-xmpp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bdb, err := bolt.Open(path.Join(dir, "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &db.DB{DB: bdb}
+	if err := d.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	s := &XmppServer{DB: d}
+	room, _ := s.rooms.getOrCreate("lobby@conference.localhost", nil)
+	clients := make(map[string]*XmppClient)
+	for _, o := range []struct{ nick, affiliation, role string }{
+		{"owner", AffiliationOwner, RoleModerator},
+		{"admin", AffiliationAdmin, RoleModerator},
+		{"moderator", AffiliationNone, RoleModerator},
+		{"member", AffiliationMember, RoleParticipant},
+		{"participant", AffiliationNone, RoleParticipant},
+		{"visitor", AffiliationNone, RoleVisitor},
+	} {
+		c := &XmppClient{JID: o.nick + "@localhost/game", server: s}
+		clients[o.nick] = c
+		room.setAffiliation(o.nick+"@localhost", o.affiliation)
+		err := room.addOccupant(&Occupant{Client: c, Nick: o.nick, Affiliation: o.affiliation, Role: o.role})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	clients["outsider"] = &XmppClient{JID: "outsider@localhost/game", server: s}
+	return room, clients, func() {
+		s.rooms.remove(room, false)
+		bdb.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// adminItem returns an <item/> of an admin query with the given
+// attribute name and value pairs
+func adminItem(attrs ...string) xmlstream.Element {
+	item := xmlstream.Element{Name: xml.Name{Space: nsMUCAdmin, Local: "item"}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		item.Attr = append(item.Attr, xml.Attr{Name: xml.Name{Local: attrs[i]}, Value: attrs[i+1]})
+	}
+	return item
+}
+
+func TestCheckMUCChange(t *testing.T) {
+	room, clients, cleanup := newAdminTestRoom(t)
+	defer cleanup()
+	tests := []struct {
+		name  string
+		actor string
+		item  xmlstream.Element
+		want  error
+	}{
+		{"moderator kicks participant", "moderator", adminItem("nick", "participant", "role", RoleNone), nil},
+		{"moderator kicks admin", "moderator", adminItem("nick", "admin", "role", RoleNone), ErrNotAllowed},
+		{"moderator kicks owner", "moderator", adminItem("nick", "owner", "role", RoleNone), ErrNotAllowed},
+		{"moderator kicks moderator", "moderator", adminItem("nick", "moderator", "role", RoleNone), ErrNotAllowed},
+		{"moderator grants moderator", "moderator", adminItem("nick", "participant", "role", RoleModerator), ErrNotAllowed},
+		{"admin revokes moderator", "admin", adminItem("nick", "moderator", "role", RoleParticipant), nil},
+		{"admin kicks owner", "admin", adminItem("nick", "owner", "role", RoleNone), ErrNotAllowed},
+		{"participant kicks", "participant", adminItem("nick", "visitor", "role", RoleNone), ErrForbidden},
+		{"visitor kicks", "visitor", adminItem("nick", "participant", "role", RoleNone), ErrForbidden},
+		{"outsider kicks", "outsider", adminItem("nick", "participant", "role", RoleNone), ErrForbidden},
+		{"kick unknown nick", "moderator", adminItem("nick", "nobody", "role", RoleNone), ErrItemNotFound},
+		{"invalid role", "moderator", adminItem("nick", "participant", "role", "king"), ErrBadRequest},
+		{"role by jid", "moderator", adminItem("jid", "participant@localhost", "role", RoleNone), ErrBadRequest},
+		{"admin grants member", "admin", adminItem("jid", "new@localhost", "affiliation", AffiliationMember), nil},
+		{"admin bans participant", "admin", adminItem("nick", "participant", "affiliation", AffiliationOutcast), nil},
+		{"admin grants admin", "admin", adminItem("jid", "new@localhost", "affiliation", AffiliationAdmin), ErrNotAllowed},
+		{"admin grants owner", "admin", adminItem("jid", "new@localhost", "affiliation", AffiliationOwner), ErrNotAllowed},
+		{"admin bans admin", "admin", adminItem("jid", "admin@localhost", "affiliation", AffiliationOutcast), ErrNotAllowed},
+		{"owner grants admin", "owner", adminItem("jid", "new@localhost", "affiliation", AffiliationAdmin), nil},
+		{"owner grants owner", "owner", adminItem("nick", "admin", "affiliation", AffiliationOwner), nil},
+		{"moderator bans", "moderator", adminItem("nick", "participant", "affiliation", AffiliationOutcast), ErrForbidden},
+		{"outsider bans", "outsider", adminItem("jid", "participant@localhost", "affiliation", AffiliationOutcast), ErrForbidden},
+		{"invalid affiliation", "owner", adminItem("jid", "new@localhost", "affiliation", "king"), ErrBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := clients[tt.actor].checkMUCChange(room, tt.item)
+			if err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMUCAdminSetChecksAllItems(t *testing.T) {
+	room, clients, cleanup := newAdminTestRoom(t)
+	defer cleanup()
+	iq := Iq{
+		Type: "set",
+		To:   room.JID,
+		Payload: xmlstream.Element{
+			Name: xml.Name{Space: nsMUCAdmin, Local: "query"},
+			Children: []xmlstream.Element{
+				adminItem("jid", "new@localhost", "affiliation", AffiliationMember),
+				adminItem("nick", "participant", "role", RoleNone),
+				adminItem("jid", "other@localhost", "affiliation", AffiliationOwner),
+			},
+		},
+	}
+	if _, err := mucAdminSet(clients["admin"], iq); err != ErrNotAllowed {
+		t.Fatalf("got %v, want %v", err, ErrNotAllowed)
+	}
+	if a := room.Affiliation("new@localhost"); a != AffiliationNone {
+		t.Errorf("affiliation of new@localhost = %v, want none", a)
+	}
+	if room.OccupantByNick("participant") == nil {
+		t.Error("participant was kicked")
+	}
+}
@@ -0,0 +1,55 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"fmt"
+
+	"github.com/redbluescreen/sbrwxmpp/chatlog"
+	"github.com/redbluescreen/sbrwxmpp/db"
+	xmlstream "github.com/redbluescreen/sbrwxmpp/xmlstream2"
+)
+
+// findMute returns the mute preventing user from sending messages to the
+// bare JID to, or nil
+func (s *XmppServer) findMute(name, to string) (*db.Mute, error) {
+	mute, err := s.DB.FindMute(name, to)
+	if err != nil || mute != nil {
+		return mute, err
+	}
+	muted, err := s.DB.IsUserMuted(name)
+	if err != nil || !muted {
+		return nil, err
+	}
+	return &db.Mute{User: name}, nil
+}
+
+// rejectMuted tells a muted client that its message was not delivered
+func (c *XmppClient) rejectMuted(e xmlstream.Element, mute *db.Mute) {
+	cfg := c.server.Config.Get().Mute
+	text := cfg.Message
+	if text == "" {
+		text = "You are muted"
+	}
+	if mute.Reason != "" {
+		text += ": " + mute.Reason
+	}
+	if !mute.ExpiresAt.IsZero() {
+		text += " (until " + formatExpiry(mute.ExpiresAt) + ")"
+	}
+	to := XMLEscape(e.GetAttr("to"))
+	switch cfg.Notify {
+	case "none":
+	case "error":
+		c.sendMessageError(e, ErrPolicyViolation.WithType(ErrorTypeCancel).WithText(text))
+	default:
+		typ := e.GetAttr("type")
+		if typ == "" {
+			typ = "normal"
+		}
+		s := "<message type='%v' from='%v' to='%v'><body>%v</body></message>"
+		c.write(fmt.Sprintf(s, XMLEscape(typ), to, XMLEscape(c.JID), XMLEscape(chatlog.SystemMessage(text))))
+	}
+}
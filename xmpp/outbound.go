@@ -0,0 +1,246 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueSize = 1024
+	writeTimeout     = 1 * time.Second
+	// maxBatchSize keeps coalesced writes within a single TLS record
+	maxBatchSize = 16384
+)
+
+const (
+	OverflowDisconnect = "disconnect"
+	OverflowDropOldest = "drop-oldest"
+)
+
+// outbound is an item in a client's send queue. If flushed is set it is
+// closed once everything queued before it has been written.
+type outbound struct {
+	data    string
+	flushed chan struct{}
+	// droppable is set for stanzas routed to the client, which the
+	// drop-oldest policy may discard. Stream and negotiation data is
+	// never dropped.
+	droppable bool
+}
+
+// sendQueue is a bounded FIFO of outbound items. Unlike a channel it lets
+// the drop-oldest policy remove an item from the middle while the writer
+// is taking items from the front.
+type sendQueue struct {
+	mu    sync.Mutex
+	items []outbound
+	size  int
+	// ready holds a value while items may be non-empty
+	ready chan struct{}
+}
+
+func newSendQueue(size int) *sendQueue {
+	return &sendQueue{
+		size:  size,
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// push appends item. If the queue is full and dropOldest is set, the
+// oldest droppable item is discarded to make room. It returns false if
+// the item wasn't queued.
+func (q *sendQueue) push(item outbound, dropOldest bool) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) >= q.size && (!dropOldest || !q.dropOldest()) {
+		return false
+	}
+	q.items = append(q.items, item)
+	q.signal()
+	return true
+}
+
+// dropOldest discards the oldest droppable item, keeping the order of the
+// others. It returns false if there is none. q.mu must be held.
+func (q *sendQueue) dropOldest() bool {
+	for i, item := range q.items {
+		if item.droppable {
+			metricQueueDropped.Inc()
+			item.done()
+			copy(q.items[i:], q.items[i+1:])
+			q.items[len(q.items)-1] = outbound{}
+			q.items = q.items[:len(q.items)-1]
+			return true
+		}
+	}
+	return false
+}
+
+// pop removes the first item. It returns false if the queue is empty.
+func (q *sendQueue) pop() (outbound, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return outbound{}, false
+	}
+	item := q.items[0]
+	q.items[0] = outbound{}
+	q.items = q.items[1:]
+	if len(q.items) > 0 {
+		q.signal()
+	}
+	return item, true
+}
+
+// signal marks the queue ready without blocking. q.mu must be held.
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue adds data to the send queue without blocking. What happens if
+// the queue is full depends on the configured overflow policy.
+func (c *XmppClient) enqueue(item outbound) {
+	select {
+	case <-c.writerQuit:
+		item.done()
+		return
+	case <-c.overflow:
+		item.done()
+		return
+	default:
+	}
+	if c.queue.push(item, c.server.Config.Get().Outbound.Overflow == OverflowDropOldest) {
+		return
+	}
+	item.done()
+	c.overflowOnce.Do(func() {
+		metricQueueOverflows.Inc()
+		c.logger.Event("queue_overflow").Print("Send queue full, disconnecting client")
+		close(c.overflow)
+	})
+}
+
+func (item outbound) done() {
+	if item.flushed != nil {
+		close(item.flushed)
+	}
+}
+
+// flush waits until everything queued so far has been written
+func (c *XmppClient) flush() {
+	flushed := make(chan struct{})
+	c.enqueue(outbound{flushed: flushed})
+	select {
+	case <-flushed:
+	case <-c.writerDone:
+	}
+}
+
+// writeLoop writes queued data to the connection until the connection is
+// closed. Stanzas that are queued together are coalesced into a single
+// write.
+func (c *XmppClient) writeLoop() {
+	defer close(c.writerDone)
+	var (
+		buf     bytes.Buffer
+		pending *outbound
+		failed  bool
+	)
+	for {
+		var item outbound
+		if pending != nil {
+			item, pending = *pending, nil
+		} else {
+			select {
+			case <-c.overflow:
+				if !failed {
+					c.writeConn([]byte("<stream:error><policy-violation xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>" +
+						"</stream:error></stream:stream>"))
+					c.closeConn()
+					failed = true
+				}
+				c.discardQueue()
+				return
+			case <-c.queue.ready:
+				var ok bool
+				if item, ok = c.queue.pop(); !ok {
+					continue
+				}
+			case <-c.writerQuit:
+				// Write what is left, the connection is closed afterwards
+				for {
+					item, ok := c.queue.pop()
+					if !ok {
+						return
+					}
+					if !failed {
+						failed = !c.writeConn([]byte(item.data))
+					}
+					item.done()
+				}
+			}
+		}
+		buf.Reset()
+		buf.WriteString(item.data)
+		flushed := []outbound{item}
+	batch:
+		for item.flushed == nil {
+			var ok bool
+			if item, ok = c.queue.pop(); !ok {
+				break batch
+			}
+			if buf.Len()+len(item.data) > maxBatchSize {
+				pending = &item
+				break batch
+			}
+			buf.WriteString(item.data)
+			flushed = append(flushed, item)
+		}
+		if !failed && buf.Len() > 0 {
+			failed = !c.writeConn(buf.Bytes())
+		}
+		for _, item := range flushed {
+			item.done()
+		}
+	}
+}
+
+func (c *XmppClient) discardQueue() {
+	for {
+		item, ok := c.queue.pop()
+		if !ok {
+			return
+		}
+		item.done()
+	}
+}
+
+// writeConn writes to the connection and closes it on errors
+func (c *XmppClient) writeConn(data []byte) bool {
+	var err error
+	if c.tlsConn != nil {
+		_ = c.tlsConn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		_, err = c.tlsConn.Write(data)
+	} else {
+		_ = c.tcpConn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		_, err = c.tcpConn.Write(data)
+	}
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			metricWriteTimeouts.Inc()
+		}
+		c.logger.Printf("failed to write: %v\n", err)
+		c.closeConn()
+		return false
+	}
+	return true
+}
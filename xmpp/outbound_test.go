@@ -0,0 +1,122 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/redbluescreen/sbrwxmpp/config"
+	"github.com/redbluescreen/sbrwxmpp/log"
+)
+
+func newTestClient(overflow string, queueSize int) (*XmppClient, net.Conn) {
+	server, client := net.Pipe()
+	cfg := &config.Config{Outbound: config.OutboundConfig{Overflow: overflow}}
+	return &XmppClient{
+		tcpConn:    server,
+		logger:     log.New("", false),
+		server:     &XmppServer{Config: config.NewStore(cfg)},
+		queue:      newSendQueue(queueSize),
+		writerQuit: make(chan struct{}),
+		writerDone: make(chan struct{}),
+		overflow:   make(chan struct{}),
+	}, client
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(c *XmppClient)
+		want  string
+	}{
+		{"stanzas", func(c *XmppClient) {
+			c.writeStanza("<a/>")
+			c.writeStanza("<b/>")
+			c.writeStanza("<c/>")
+		}, "<b/><c/>"},
+		{"keeps protocol data", func(c *XmppClient) {
+			c.write("<success/>")
+			c.writeStanza("<a/>")
+			c.writeStanza("<b/>")
+		}, "<success/><b/>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, conn := newTestClient(OverflowDropOldest, 2)
+			tt.write(c)
+			go c.writeLoop()
+			close(c.writerQuit)
+			go func() {
+				<-c.writerDone
+				c.closeConn()
+			}()
+			data, _ := ioutil.ReadAll(conn)
+			if string(data) != tt.want {
+				t.Errorf("got %q, want %q", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueDropOldestDisconnect(t *testing.T) {
+	c, conn := newTestClient(OverflowDropOldest, 2)
+	c.write("<proceed/>")
+	c.write("<success/>")
+	c.writeStanza("<a/>")
+	go c.writeLoop()
+	data, _ := ioutil.ReadAll(conn)
+	if !strings.Contains(string(data), "<policy-violation") || strings.Contains(string(data), "<a/>") {
+		t.Errorf("got %q, want policy-violation error", data)
+	}
+	<-c.writerDone
+}
+
+func TestQueueDisconnect(t *testing.T) {
+	c, conn := newTestClient(OverflowDisconnect, 2)
+	c.write("<a/>")
+	c.write("<b/>")
+	c.write("<c/>")
+	go c.writeLoop()
+	data, _ := ioutil.ReadAll(conn)
+	if !strings.Contains(string(data), "<policy-violation") || strings.Contains(string(data), "<c/>") {
+		t.Errorf("got %q, want policy-violation error", data)
+	}
+	<-c.writerDone
+}
+
+func TestQueueDropOldestOrder(t *testing.T) {
+	c, conn := newTestClient(OverflowDropOldest, 8)
+	go c.writeLoop()
+	go func() {
+		for i := 0; i < 2000; i++ {
+			c.writeStanza(fmt.Sprintf("<m n='%v'/>", i))
+		}
+		close(c.writerQuit)
+		<-c.writerDone
+		c.closeConn()
+	}()
+	data, _ := ioutil.ReadAll(conn)
+	last := -1
+	for _, s := range strings.SplitAfter(string(data), "/>") {
+		if s == "" {
+			continue
+		}
+		var n int
+		if _, err := fmt.Sscanf(s, "<m n='%d'/>", &n); err != nil {
+			t.Fatalf("unexpected data %q", s)
+		}
+		if n <= last {
+			t.Fatalf("stanza %v written after %v", n, last)
+		}
+		last = n
+	}
+	if last != 1999 {
+		t.Errorf("last stanza written is %v, want 1999", last)
+	}
+}
@@ -0,0 +1,210 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const registryShards = 32
+
+// sessionRegistry indexes available clients by JID. It is sharded by bare
+// JID so logins and lookups of different users don't contend, and every
+// shard keeps an immutable snapshot for lock-free iteration.
+type sessionRegistry struct {
+	shards [registryShards]sessionShard
+}
+
+type sessionShard struct {
+	sync.RWMutex
+	// clients maps lowercased bare JIDs to the sessions of that user
+	clients  map[string][]*XmppClient
+	snapshot atomic.Value // []*XmppClient
+}
+
+func (r *sessionRegistry) shard(bare string) *sessionShard {
+	h := fnv.New32a()
+	h.Write([]byte(bare))
+	return &r.shards[h.Sum32()%registryShards]
+}
+
+// add registers a client under its current JID. It returns false if the
+// client was already registered.
+func (r *sessionRegistry) add(c *XmppClient) bool {
+	bare := bareJID(c.JID)
+	sh := r.shard(bare)
+	sh.Lock()
+	defer sh.Unlock()
+	for _, cl := range sh.clients[bare] {
+		if cl == c {
+			return false
+		}
+	}
+	if sh.clients == nil {
+		sh.clients = make(map[string][]*XmppClient)
+	}
+	sh.clients[bare] = append(sh.clients[bare], c)
+	sh.updateSnapshot()
+	return true
+}
+
+// remove unregisters a client. It returns false if the client wasn't
+// registered.
+func (r *sessionRegistry) remove(c *XmppClient) bool {
+	bare := bareJID(c.JID)
+	sh := r.shard(bare)
+	sh.Lock()
+	defer sh.Unlock()
+	clients := sh.clients[bare]
+	for i, cl := range clients {
+		if cl != c {
+			continue
+		}
+		if len(clients) == 1 {
+			delete(sh.clients, bare)
+		} else {
+			// Copy so slices returned by find stay valid
+			rest := make([]*XmppClient, 0, len(clients)-1)
+			rest = append(rest, clients[:i]...)
+			sh.clients[bare] = append(rest, clients[i+1:]...)
+		}
+		sh.updateSnapshot()
+		return true
+	}
+	return false
+}
+
+// updateSnapshot must be called with the shard locked
+func (sh *sessionShard) updateSnapshot() {
+	all := make([]*XmppClient, 0, len(sh.clients))
+	for _, clients := range sh.clients {
+		all = append(all, clients...)
+	}
+	sh.snapshot.Store(all)
+}
+
+// find returns all sessions of a bare JID. The returned slice must not
+// be modified.
+func (r *sessionRegistry) find(bare string) []*XmppClient {
+	bare = strings.ToLower(bare)
+	sh := r.shard(bare)
+	sh.RLock()
+	defer sh.RUnlock()
+	return sh.clients[bare]
+}
+
+// lookup returns the session with the given full JID, or any session of
+// the user for a bare JID.
+func (r *sessionRegistry) lookup(jid string) *XmppClient {
+	clients := r.find(bareJID(jid))
+	if !strings.Contains(jid, "/") {
+		if len(clients) == 0 {
+			return nil
+		}
+		return clients[0]
+	}
+	for _, c := range clients {
+		if c.JID == jid {
+			return c
+		}
+	}
+	return nil
+}
+
+// all returns every registered session without locking
+func (r *sessionRegistry) all() []*XmppClient {
+	var all []*XmppClient
+	for i := range r.shards {
+		clients, _ := r.shards[i].snapshot.Load().([]*XmppClient)
+		all = append(all, clients...)
+	}
+	return all
+}
+
+// roomRegistry indexes rooms by lowercased room JID
+type roomRegistry struct {
+	sync.RWMutex
+	rooms    map[string]*XmppRoom
+	snapshot atomic.Value // []*XmppRoom
+}
+
+func (r *roomRegistry) get(jid string) *XmppRoom {
+	r.RLock()
+	defer r.RUnlock()
+	return r.rooms[strings.ToLower(jid)]
+}
+
+// getOrCreate returns the room with the given JID, creating it if it
+// doesn't exist. init sets up a new room before it becomes visible, so
+// that nobody can join it half set up. It runs without the registry
+// locked, if another room with the JID was added meanwhile that one is
+// returned instead.
+func (r *roomRegistry) getOrCreate(jid string, init func(room *XmppRoom)) (room *XmppRoom, created bool) {
+	if room = r.get(jid); room != nil {
+		return room, false
+	}
+	fresh := &XmppRoom{JID: jid}
+	if init != nil {
+		init(fresh)
+	}
+	key := strings.ToLower(jid)
+	r.Lock()
+	defer r.Unlock()
+	if room = r.rooms[key]; room != nil {
+		return room, false
+	}
+	if r.rooms == nil {
+		r.rooms = make(map[string]*XmppRoom)
+	}
+	r.rooms[key] = fresh
+	r.updateSnapshot()
+	metricRooms.Inc()
+	return fresh, true
+}
+
+// remove removes a room from the registry and marks it destroyed so it
+// can't be joined anymore. If ifEmpty is set only empty rooms that aren't
+// persistent are removed. It returns false if the room wasn't removed.
+func (r *roomRegistry) remove(room *XmppRoom, ifEmpty bool) bool {
+	key := strings.ToLower(room.JID)
+	r.Lock()
+	defer r.Unlock()
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if room.destroyed || r.rooms[key] != room {
+		return false
+	}
+	if ifEmpty && (room.options.Persistent || len(room.Occupants()) > 0) {
+		return false
+	}
+	room.destroyed = true
+	delete(r.rooms, key)
+	r.updateSnapshot()
+	metricRooms.Dec()
+	metricRoomMembers.Delete(room.JID)
+	return true
+}
+
+// updateSnapshot must be called with the registry locked
+func (r *roomRegistry) updateSnapshot() {
+	all := make([]*XmppRoom, 0, len(r.rooms))
+	for _, room := range r.rooms {
+		all = append(all, room)
+	}
+	r.snapshot.Store(all)
+}
+
+// all returns every room without locking
+func (r *roomRegistry) all() []*XmppRoom {
+	rooms, _ := r.snapshot.Load().([]*XmppRoom)
+	return rooms
+}
+
+func bareJID(jid string) string {
+	return strings.ToLower(strings.Split(jid, "/")[0])
+}
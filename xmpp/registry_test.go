@@ -0,0 +1,94 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/redbluescreen/sbrwxmpp/metrics"
+)
+
+func TestSessionRegistry(t *testing.T) {
+	var r sessionRegistry
+	a := &XmppClient{JID: "Alice@localhost/game"}
+	b := &XmppClient{JID: "bob@localhost/game"}
+	if !r.add(a) || !r.add(b) {
+		t.Fatal("add failed")
+	}
+	if r.add(a) {
+		t.Error("added client twice")
+	}
+	if c := r.lookup("alice@localhost"); c != a {
+		t.Errorf("lookup by bare JID = %v, want alice", c)
+	}
+	if c := r.lookup("Alice@localhost/game"); c != a {
+		t.Errorf("lookup by full JID = %v, want alice", c)
+	}
+	if c := r.lookup("Alice@localhost/other"); c != nil {
+		t.Errorf("lookup of other resource = %v, want nil", c)
+	}
+	if n := len(r.all()); n != 2 {
+		t.Errorf("all returned %v sessions, want 2", n)
+	}
+	if !r.remove(a) || r.remove(a) {
+		t.Error("remove should succeed exactly once")
+	}
+	if c := r.lookup("alice@localhost"); c != nil {
+		t.Errorf("lookup after remove = %v, want nil", c)
+	}
+	if all := r.all(); len(all) != 1 || all[0] != b {
+		t.Errorf("all = %v, want [bob]", all)
+	}
+}
+
+func TestRoomRegistry(t *testing.T) {
+	var r roomRegistry
+	inits := 0
+	init := func(room *XmppRoom) {
+		inits++
+		// The registry must not be locked while a room is set up
+		r.get("other@conference.localhost")
+		room.setAffiliation("alice@localhost", AffiliationOutcast)
+	}
+	room, created := r.getOrCreate("Lobby@conference.localhost", init)
+	if !created {
+		t.Fatal("room not created")
+	}
+	if again, created := r.getOrCreate("lobby@conference.localhost", init); created || again != room {
+		t.Error("room JIDs should be case-insensitive")
+	}
+	if inits != 1 || room.Affiliation("alice@localhost") != AffiliationOutcast {
+		t.Errorf("init called %v times, want once before the room is returned", inits)
+	}
+	room.setAffiliation("alice@localhost", AffiliationNone)
+	c := &XmppClient{JID: "alice@localhost/game"}
+	o := &Occupant{Client: c, Nick: "alice"}
+	if room.addOccupant(o) != nil || room.addOccupant(o) != errJoined {
+		t.Error("addOccupant should succeed exactly once")
+	}
+	if rooms := c.JoinedRooms(); len(rooms) != 1 || rooms[0] != room {
+		t.Errorf("JoinedRooms = %v, want [lobby]", rooms)
+	}
+	if rooms := r.all(); len(rooms) != 1 {
+		t.Errorf("all returned %v rooms, want 1", len(rooms))
+	}
+	if r.remove(room, true) {
+		t.Error("removed a room with occupants")
+	}
+	room.removeOccupant(c)
+	if !r.remove(room, true) || r.get("lobby@conference.localhost") != nil {
+		t.Error("empty room not removed")
+	}
+	if room.addOccupant(o) != errDestroyed {
+		t.Error("joined a destroyed room")
+	}
+	var buf bytes.Buffer
+	metrics.WriteText(&buf)
+	if strings.Contains(buf.String(), `room="Lobby@conference.localhost"`) {
+		t.Error("member gauge of removed room still exported")
+	}
+}
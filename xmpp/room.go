@@ -0,0 +1,470 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redbluescreen/sbrwxmpp/db"
+	xmlstream "github.com/redbluescreen/sbrwxmpp/xmlstream2"
+)
+
+const nsMUCUser = "http://jabber.org/protocol/muc#user"
+
+// Affiliations and roles from XEP-0045
+const (
+	AffiliationOwner   = "owner"
+	AffiliationAdmin   = "admin"
+	AffiliationMember  = "member"
+	AffiliationNone    = "none"
+	AffiliationOutcast = "outcast"
+
+	RoleModerator   = "moderator"
+	RoleParticipant = "participant"
+	RoleVisitor     = "visitor"
+	RoleNone        = "none"
+)
+
+// Status codes of MUC presences
+const (
+	statusSelf    = 110
+	statusBanned  = 301
+	statusNewNick = 303
+	statusKicked  = 307
+)
+
+// affiliationRank orders affiliations by privileges. It is zero for
+// unknown affiliations.
+func affiliationRank(affiliation string) int {
+	switch affiliation {
+	case AffiliationOwner:
+		return 5
+	case AffiliationAdmin:
+		return 4
+	case AffiliationMember:
+		return 3
+	case AffiliationNone:
+		return 2
+	case AffiliationOutcast:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func validRole(role string) bool {
+	switch role {
+	case RoleModerator, RoleParticipant, RoleVisitor, RoleNone:
+		return true
+	default:
+		return false
+	}
+}
+
+// Occupant is a client in a room. Occupants are never modified, changes
+// replace them.
+type Occupant struct {
+	Client      *XmppClient
+	Nick        string
+	Affiliation string
+	Role        string
+}
+
+type XmppRoom struct {
+	JID string
+	mu  sync.Mutex
+	// occupants is replaced on every change, so snapshots can be read
+	// without locking
+	occupants atomic.Value // []*Occupant
+	history   roomHistory
+	// The fields below are guarded by mu. subjectBy is the nick that set
+	// the subject.
+	subject   string
+	subjectBy string
+	// affiliations and roles map lowercased bare JIDs to affiliations
+	// and roles set by admins and moderators
+	affiliations map[string]string
+	roles        map[string]string
+	// stored rooms keep their state in the database
+	stored  bool
+	options db.RoomOptions
+	// destroyed rooms have been removed from the registry and can't be
+	// joined
+	destroyed bool
+}
+
+// Occupants returns a snapshot of the occupants of the room
+func (r *XmppRoom) Occupants() []*Occupant {
+	occupants, _ := r.occupants.Load().([]*Occupant)
+	return occupants
+}
+
+// Members returns a snapshot of the clients in the room
+func (r *XmppRoom) Members() []*XmppClient {
+	occupants := r.Occupants()
+	members := make([]*XmppClient, len(occupants))
+	for i, o := range occupants {
+		members[i] = o.Client
+	}
+	return members
+}
+
+// Occupant returns the occupant of a client, or nil
+func (r *XmppRoom) Occupant(c *XmppClient) *Occupant {
+	for _, o := range r.Occupants() {
+		if o.Client == c {
+			return o
+		}
+	}
+	return nil
+}
+
+// OccupantByNick returns the occupant using nick, or nil
+func (r *XmppRoom) OccupantByNick(nick string) *Occupant {
+	for _, o := range r.Occupants() {
+		if strings.EqualFold(o.Nick, nick) {
+			return o
+		}
+	}
+	return nil
+}
+
+func (r *XmppRoom) RouteMessage(msg xmlstream.Element) {
+	from := msg.GetAttr("from")
+	nick := strings.Split(from, "@")[0]
+	if o := r.occupantByJID(from); o != nil {
+		nick = o.Nick
+	}
+	msg.SetAttr("from", r.JID+"/"+nick)
+	if _, ok := msg.GetChild("body"); ok {
+		stored := msg
+		stored.Attr = append([]xml.Attr(nil), msg.Attr...)
+		r.history.add(stored, time.Now())
+	}
+	for _, member := range r.Members() {
+		msg.SetAttr("to", member.JID)
+		member.SendXML(msg)
+	}
+}
+
+// RoutePrivateMessage sends a message addressed to the occupant JID of
+// nick to the real JID of that occupant, from the occupant JID of the
+// sender. Only occupants can send private messages.
+func (r *XmppRoom) RoutePrivateMessage(msg xmlstream.Element, nick string) error {
+	sender := r.occupantByJID(msg.GetAttr("from"))
+	if sender == nil {
+		return ErrNotAcceptable
+	}
+	target := r.OccupantByNick(nick)
+	if target == nil {
+		return ErrItemNotFound
+	}
+	// Don't change the attributes of the caller's element
+	msg.Attr = append([]xml.Attr(nil), msg.Attr...)
+	msg.SetAttr("from", r.JID+"/"+sender.Nick)
+	msg.SetAttr("to", target.Client.JID)
+	target.Client.SendXML(msg)
+	return nil
+}
+
+// occupantByJID returns the occupant with the full JID jid, or nil
+func (r *XmppRoom) occupantByJID(jid string) *Occupant {
+	for _, o := range r.Occupants() {
+		if o.Client.JID == jid {
+			return o
+		}
+	}
+	return nil
+}
+
+var (
+	errJoined    = errors.New("already in the room")
+	errNickInUse = errors.New("nick in use")
+	errDestroyed = errors.New("room destroyed")
+)
+
+// addOccupant adds an occupant to the room
+func (r *XmppRoom) addOccupant(o *Occupant) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.destroyed {
+		return errDestroyed
+	}
+	occupants := r.Occupants()
+	for _, existing := range occupants {
+		if existing.Client == o.Client {
+			return errJoined
+		}
+		if strings.EqualFold(existing.Nick, o.Nick) {
+			return errNickInUse
+		}
+	}
+	updated := make([]*Occupant, len(occupants), len(occupants)+1)
+	copy(updated, occupants)
+	r.occupants.Store(append(updated, o))
+	o.Client.addRoom(r)
+	metricRoomMembers.With(r.JID).Inc()
+	return nil
+}
+
+// replaceOccupant replaces old with o. It returns false if old is no
+// longer in the room.
+func (r *XmppRoom) replaceOccupant(old, o *Occupant) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	occupants := r.Occupants()
+	for i, existing := range occupants {
+		if existing == old {
+			updated := append([]*Occupant(nil), occupants...)
+			updated[i] = o
+			r.occupants.Store(updated)
+			return true
+		}
+	}
+	return false
+}
+
+// changeNick replaces old with an occupant using nick. It returns nil
+// if the nick is used by another occupant or old is no longer in the
+// room.
+func (r *XmppRoom) changeNick(old *Occupant, nick string) *Occupant {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	occupants := r.Occupants()
+	index := -1
+	for i, existing := range occupants {
+		if existing == old {
+			index = i
+		} else if strings.EqualFold(existing.Nick, nick) {
+			return nil
+		}
+	}
+	if index < 0 {
+		return nil
+	}
+	updated := *old
+	updated.Nick = nick
+	changed := append([]*Occupant(nil), occupants...)
+	changed[index] = &updated
+	r.occupants.Store(changed)
+	return &updated
+}
+
+// removeOccupant removes the client from the room and returns its
+// occupant and the occupants before the removal, or nil if it wasn't in
+// the room
+func (r *XmppRoom) removeOccupant(c *XmppClient) (*Occupant, []*Occupant) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	occupants := r.Occupants()
+	updated := make([]*Occupant, 0, len(occupants))
+	var removed *Occupant
+	for _, o := range occupants {
+		if o.Client == c {
+			removed = o
+		} else {
+			updated = append(updated, o)
+		}
+	}
+	if removed == nil {
+		return nil, nil
+	}
+	r.occupants.Store(updated)
+	c.removeRoom(r)
+	// The gauge of a destroyed room is deleted, a new room with the same
+	// JID may use it already
+	if !r.destroyed {
+		metricRoomMembers.With(r.JID).Dec()
+	}
+	return removed, occupants
+}
+
+// removeMember removes a client from the room and sends the unavailable
+// presence p to all occupants including itself. It returns nil if the
+// client wasn't in the room.
+func (r *XmppRoom) removeMember(c *XmppClient, p mucPresence) *Occupant {
+	removed, occupants := r.removeOccupant(c)
+	if removed == nil {
+		return nil
+	}
+	p.unavailable = true
+	for _, o := range occupants {
+		o.Client.writeStanza(r.occupantPresence(removed, o.Client, p))
+	}
+	return removed
+}
+
+// broadcastPresence sends the presence of o to all occupants
+func (r *XmppRoom) broadcastPresence(o *Occupant, reason string) {
+	for _, member := range r.Members() {
+		member.writeStanza(r.occupantPresence(o, member, mucPresence{reason: reason}))
+	}
+}
+
+// mucPresence describes an occupant presence. The zero value is a plain
+// available presence.
+type mucPresence struct {
+	unavailable bool
+	reason      string
+	// newNick is set for the unavailable presence of a nick change
+	newNick string
+	// destroy is set for the unavailable presences sent when the room
+	// is destroyed
+	destroy bool
+	codes   []int
+}
+
+// occupantPresence returns the presence of o sent to the client to
+func (r *XmppRoom) occupantPresence(o *Occupant, to *XmppClient, p mucPresence) string {
+	typ := ""
+	role := o.Role
+	if p.unavailable {
+		typ = " type='unavailable'"
+		if p.newNick == "" {
+			role = RoleNone
+		}
+	}
+	s := fmt.Sprintf("<presence from='%v' to='%v'%v><x xmlns='%v'><item affiliation='%v' role='%v'",
+		XMLEscape(r.JID+"/"+o.Nick), XMLEscape(to.JID), typ, nsMUCUser, o.Affiliation, role)
+	if p.newNick != "" {
+		s += " nick='" + XMLEscape(p.newNick) + "'"
+	}
+	if p.reason != "" && !p.destroy {
+		s += "><reason>" + XMLEscape(p.reason) + "</reason></item>"
+	} else {
+		s += "/>"
+	}
+	if p.destroy && p.reason != "" {
+		s += "<destroy><reason>" + XMLEscape(p.reason) + "</reason></destroy>"
+	} else if p.destroy {
+		s += "<destroy/>"
+	}
+	for _, code := range p.codes {
+		s += fmt.Sprintf("<status code='%v'/>", code)
+	}
+	if o.Client == to {
+		s += fmt.Sprintf("<status code='%v'/>", statusSelf)
+	}
+	return s + "</x></presence>"
+}
+
+// Affiliation returns the affiliation of a bare JID set in the room
+func (r *XmppRoom) Affiliation(bare string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if a, ok := r.affiliations[strings.ToLower(bare)]; ok {
+		return a
+	}
+	return AffiliationNone
+}
+
+// Affiliations returns a copy of the affiliations set in the room
+func (r *XmppRoom) Affiliations() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	affiliations := make(map[string]string, len(r.affiliations))
+	for jid, a := range r.affiliations {
+		affiliations[jid] = a
+	}
+	return affiliations
+}
+
+// setAffiliation changes the affiliation of a bare JID. It returns
+// whether the room is stored.
+func (r *XmppRoom) setAffiliation(bare, affiliation string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	bare = strings.ToLower(bare)
+	if affiliation == AffiliationNone {
+		delete(r.affiliations, bare)
+	} else {
+		if r.affiliations == nil {
+			r.affiliations = make(map[string]string)
+		}
+		r.affiliations[bare] = affiliation
+	}
+	return r.stored
+}
+
+// roleOverride returns the role a moderator gave a bare JID, or an empty
+// string
+func (r *XmppRoom) roleOverride(bare string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.roles[strings.ToLower(bare)]
+}
+
+// setRoleOverride remembers the role of a bare JID for later joins. It
+// returns whether the room is stored.
+func (r *XmppRoom) setRoleOverride(bare, role string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	bare = strings.ToLower(bare)
+	if role == RoleNone {
+		delete(r.roles, bare)
+	} else {
+		if r.roles == nil {
+			r.roles = make(map[string]string)
+		}
+		r.roles[bare] = role
+	}
+	return r.stored
+}
+
+// roleOverrides returns a copy of the roles set by moderators
+func (r *XmppRoom) roleOverrides() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	roles := make(map[string]string, len(r.roles))
+	for jid, role := range r.roles {
+		roles[jid] = role
+	}
+	return roles
+}
+
+// roleFor returns the role of an occupant with the bare JID and
+// affiliation. Admins and owners are always moderators, occupants
+// without an affiliation are visitors in moderated rooms.
+func (r *XmppRoom) roleFor(bare, affiliation string) string {
+	if affiliationRank(affiliation) >= affiliationRank(AffiliationAdmin) {
+		return RoleModerator
+	}
+	if role := r.roleOverride(bare); role != "" && role != RoleNone {
+		return role
+	}
+	if affiliationRank(affiliation) < affiliationRank(AffiliationMember) && r.Options().Moderated {
+		return RoleVisitor
+	}
+	return RoleParticipant
+}
+
+// setStored makes the room keep its state in the database. It returns
+// false if it already did.
+func (r *XmppRoom) setStored() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := !r.stored
+	r.stored = true
+	return changed
+}
+
+// Options returns the settings of the room
+func (r *XmppRoom) Options() db.RoomOptions {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.options
+}
+
+func (r *XmppRoom) setOptions(options db.RoomOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.options = options
+}
@@ -0,0 +1,122 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/redbluescreen/sbrwxmpp/db"
+	xmlstream "github.com/redbluescreen/sbrwxmpp/xmlstream2"
+)
+
+func TestRoomRoles(t *testing.T) {
+	r := &XmppRoom{JID: "lobby@conference.localhost"}
+	r.setAffiliation("Alice@localhost", AffiliationAdmin)
+	r.setRoleOverride("bob@localhost", RoleVisitor)
+	if a := r.Affiliation("alice@localhost"); a != AffiliationAdmin {
+		t.Errorf("affiliation = %v, want admin", a)
+	}
+	if role := r.roleFor("alice@localhost", AffiliationAdmin); role != RoleModerator {
+		t.Errorf("admin role = %v, want moderator", role)
+	}
+	if role := r.roleFor("Bob@localhost", AffiliationNone); role != RoleVisitor {
+		t.Errorf("devoiced role = %v, want visitor", role)
+	}
+	r.setOptions(db.RoomOptions{Moderated: true})
+	if role := r.roleFor("carol@localhost", AffiliationNone); role != RoleVisitor {
+		t.Errorf("moderated room role = %v, want visitor", role)
+	}
+	if role := r.roleFor("carol@localhost", AffiliationMember); role != RoleParticipant {
+		t.Errorf("moderated room member role = %v, want participant", role)
+	}
+	r.setRoleOverride("bob@localhost", RoleNone)
+	if roles := r.roleOverrides(); len(roles) != 0 {
+		t.Errorf("role none stored: %v", roles)
+	}
+	r.setAffiliation("alice@localhost", AffiliationNone)
+	if affiliations := r.Affiliations(); len(affiliations) != 0 {
+		t.Errorf("affiliation none stored: %v", affiliations)
+	}
+}
+
+func TestOccupantPresence(t *testing.T) {
+	r := &XmppRoom{JID: "lobby@conference.localhost"}
+	alice := &XmppClient{JID: "alice@localhost/game"}
+	bob := &XmppClient{JID: "bob@localhost/game"}
+	o := &Occupant{Client: bob, Nick: "bob", Affiliation: AffiliationNone, Role: RoleParticipant}
+	want := "<presence from='lobby@conference.localhost/bob' to='alice@localhost/game' type='unavailable'>" +
+		"<x xmlns='http://jabber.org/protocol/muc#user'><item affiliation='none' role='none'>" +
+		"<reason>spam</reason></item><status code='307'/></x></presence>"
+	if got := r.occupantPresence(o, alice, mucPresence{unavailable: true, reason: "spam", codes: []int{statusKicked}}); got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+	want = "<presence from='lobby@conference.localhost/bob' to='bob@localhost/game'>" +
+		"<x xmlns='http://jabber.org/protocol/muc#user'><item affiliation='none' role='participant'/>" +
+		"<status code='110'/></x></presence>"
+	if got := r.occupantPresence(o, bob, mucPresence{}); got != want {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestRoomNicks(t *testing.T) {
+	r := &XmppRoom{JID: "lobby@conference.localhost"}
+	alice := &Occupant{Client: &XmppClient{JID: "alice@localhost/game"}, Nick: "racer"}
+	bob := &Occupant{Client: &XmppClient{JID: "bob@localhost/game"}, Nick: "Racer"}
+	if err := r.addOccupant(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.addOccupant(bob); err != errNickInUse {
+		t.Errorf("joining with a nick in use: got %v", err)
+	}
+	bob.Nick = "bob"
+	if err := r.addOccupant(bob); err != nil {
+		t.Fatal(err)
+	}
+	if r.changeNick(bob, "RACER") != nil {
+		t.Error("changed to a nick in use")
+	}
+	updated := r.changeNick(alice, "alice")
+	if updated == nil || r.OccupantByNick("ALICE") != updated || r.OccupantByNick("racer") != nil {
+		t.Errorf("nick change failed: %v", r.Occupants())
+	}
+	if r.changeNick(alice, "other") != nil {
+		t.Error("changed the nick of a replaced occupant")
+	}
+}
+
+func TestRoutePrivateMessage(t *testing.T) {
+	r := &XmppRoom{JID: "lobby@conference.localhost"}
+	alice, _ := newTestClient(OverflowDisconnect, 1)
+	alice.JID = "alice@localhost/game"
+	bob, _ := newTestClient(OverflowDisconnect, 1)
+	bob.JID = "bob@localhost/game"
+	r.addOccupant(&Occupant{Client: alice, Nick: "racer"})
+	r.addOccupant(&Occupant{Client: bob, Nick: "bob"})
+	defer r.removeOccupant(alice)
+	defer r.removeOccupant(bob)
+
+	msg := xmlstream.Element{Name: xml.Name{Local: "message"}}
+	msg.SetAttr("from", "alice@localhost/game")
+	msg.SetAttr("to", "lobby@conference.localhost/Bob")
+	msg.SetAttr("type", "chat")
+	if err := r.RoutePrivateMessage(msg, "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	want := `<message from="lobby@conference.localhost/racer" to="bob@localhost/game" type="chat"></message>`
+	if item, _ := bob.queue.pop(); item.data != want {
+		t.Errorf("got %v\nwant %v", item.data, want)
+	}
+	if to := msg.GetAttr("to"); to != "lobby@conference.localhost/Bob" {
+		t.Errorf("routing changed the message to %v", to)
+	}
+	if err := r.RoutePrivateMessage(msg, "carol"); err != ErrItemNotFound {
+		t.Errorf("message to missing occupant: got %v", err)
+	}
+	msg.SetAttr("from", "carol@localhost/game")
+	if err := r.RoutePrivateMessage(msg, "bob"); err != ErrNotAcceptable {
+		t.Errorf("message from non-occupant: got %v", err)
+	}
+}
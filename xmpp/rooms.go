@@ -0,0 +1,194 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redbluescreen/sbrwxmpp/db"
+	"github.com/redbluescreen/sbrwxmpp/events"
+	"github.com/redbluescreen/sbrwxmpp/log"
+)
+
+// RoomJID returns the JID of the room with the given local part
+func (s *XmppServer) RoomJID(name string) string {
+	return name + "@conference." + s.Config.Get().Domain
+}
+
+// openRoom returns the room with the given JID, creating it and
+// restoring its stored state if it doesn't exist yet. creator is the
+// client causing the room to be created, or nil.
+func (s *XmppServer) openRoom(jid string, creator *XmppClient) *XmppRoom {
+	room, created := s.rooms.getOrCreate(jid, s.loadRoom)
+	if !created {
+		return room
+	}
+	s.Logger.Category(log.Routing).With(log.Fields{"room": room.JID}).Debug("Created room")
+	if creator != nil {
+		s.Events.Publish(creator.roomEvent(events.RoomCreated, room))
+	} else {
+		s.Events.Publish(newRoomEvent(events.RoomCreated, room))
+	}
+	return room
+}
+
+// loadRoom restores the stored state of a room before it is added to the
+// registry. It runs without the registry locked.
+func (s *XmppServer) loadRoom(room *XmppRoom) {
+	stored, err := s.DB.GetRoom(room.JID)
+	if err != nil {
+		s.Logger.Category(log.Routing).Printf("error loading room %v: %v", room.JID, err)
+	} else if stored != nil {
+		room.mu.Lock()
+		room.subject = stored.Subject
+		room.subjectBy = stored.SubjectBy
+		room.affiliations = stored.Affiliations
+		room.roles = stored.Roles
+		room.options = stored.Options
+		room.stored = true
+		room.mu.Unlock()
+	}
+	if options, ok := s.configRooms[strings.ToLower(room.JID)]; ok {
+		room.mu.Lock()
+		room.options = options
+		room.stored = true
+		room.mu.Unlock()
+	}
+	room.history.setLimits(s.roomHistoryLimits(room))
+}
+
+// storeRoom saves the affiliations and roles of a room
+func (s *XmppServer) storeRoom(room *XmppRoom) error {
+	affiliations := room.Affiliations()
+	roles := room.roleOverrides()
+	return s.DB.UpdateRoom(room.JID, func(r *db.Room) error {
+		r.Affiliations = affiliations
+		r.Roles = roles
+		return nil
+	})
+}
+
+// roomHistoryLimits returns the history limits of a room, taking its
+// history size option into account
+func (s *XmppServer) roomHistoryLimits(room *XmppRoom) (int, time.Duration) {
+	maxStanzas, maxAge := s.historyLimits(room.JID)
+	if size := room.Options().HistorySize; size != 0 {
+		maxStanzas = size
+	}
+	return maxStanzas, maxAge
+}
+
+// openRooms creates the persistent rooms from the database and the rooms
+// from the configuration. The options of configured rooms are not stored,
+// so that removing a room from the configuration removes it for good.
+func (s *XmppServer) openRooms() error {
+	s.configRooms = make(map[string]db.RoomOptions)
+	for _, room := range s.Config.Get().Rooms {
+		s.configRooms[strings.ToLower(s.RoomJID(room.Name))] = db.RoomOptions{
+			Persistent:   true,
+			MaxOccupants: room.MaxOccupants,
+			MembersOnly:  room.MembersOnly,
+			Password:     room.Password,
+			Moderated:    room.Moderated,
+			HistorySize:  room.HistorySize,
+		}
+	}
+	stored, err := s.DB.GetRooms()
+	if err != nil {
+		return err
+	}
+	for _, room := range stored {
+		if room.Options.Persistent {
+			s.openRoom(room.JID, nil)
+		}
+	}
+	for _, room := range s.Config.Get().Rooms {
+		s.openRoom(s.RoomJID(room.Name), nil)
+	}
+	return nil
+}
+
+// ErrRoomConfigured is returned when changing the options of a room that
+// is set up in the configuration
+var ErrRoomConfigured = errors.New("room options are set in the configuration")
+
+// ConfigureRoom stores the options of a room and applies them to the
+// room if it exists. Persistent rooms are created if they don't exist,
+// other rooms get the options when they are created.
+func (s *XmppServer) ConfigureRoom(jid string, options db.RoomOptions) error {
+	if _, ok := s.configRooms[strings.ToLower(jid)]; ok {
+		return ErrRoomConfigured
+	}
+	err := s.DB.UpdateRoom(jid, func(r *db.Room) error {
+		r.Options = options
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	room := s.rooms.get(jid)
+	if room == nil {
+		if options.Persistent {
+			s.openRoom(jid, nil)
+		}
+		return nil
+	}
+	room.setOptions(options)
+	room.setStored()
+	room.history.setLimits(s.roomHistoryLimits(room))
+	s.destroyIfEmpty(room)
+	return nil
+}
+
+// leaveRoom removes a client from a room, sending the unavailable
+// presence p, and destroys the room if it is empty and not persistent.
+// The leave event gets the reason why. It returns false if the client
+// wasn't in the room.
+func (s *XmppServer) leaveRoom(room *XmppRoom, c *XmppClient, p mucPresence, why string) bool {
+	if room.removeMember(c, p) == nil {
+		return false
+	}
+	c.logger.Category(log.Routing).With(log.Fields{"room": room.JID}).Debug("Removed client from room")
+	e := c.roomEvent(events.RoomLeave, room)
+	e.Reason = why
+	s.Events.Publish(e)
+	s.destroyIfEmpty(room)
+	return true
+}
+
+// destroyIfEmpty destroys a room without occupants unless it is
+// persistent
+func (s *XmppServer) destroyIfEmpty(room *XmppRoom) {
+	if s.rooms.remove(room, true) {
+		s.Logger.Category(log.Routing).With(log.Fields{"room": room.JID}).Debug("Destroyed empty room")
+		s.Events.Publish(newRoomEvent(events.RoomDestroyed, room))
+	}
+}
+
+// DestroyRoom removes all occupants from a room, destroys it and deletes
+// its stored state. It returns false if the room neither exists nor is
+// stored.
+func (s *XmppServer) DestroyRoom(jid, reason string) (bool, error) {
+	found, err := s.DB.DeleteRoom(jid)
+	if err != nil {
+		return false, err
+	}
+	room := s.rooms.get(jid)
+	if room == nil || !s.rooms.remove(room, false) {
+		return found, nil
+	}
+	s.Logger.Category(log.Routing).With(log.Fields{"room": room.JID}).Print("Destroying room")
+	for _, o := range room.Occupants() {
+		if room.removeMember(o.Client, mucPresence{reason: reason, destroy: true}) != nil {
+			e := o.Client.roomEvent(events.RoomLeave, room)
+			e.Reason = "destroyed"
+			s.Events.Publish(e)
+		}
+	}
+	s.Events.Publish(newRoomEvent(events.RoomDestroyed, room))
+	return true, nil
+}
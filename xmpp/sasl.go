@@ -0,0 +1,290 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"github.com/redbluescreen/sbrwxmpp/log"
+	"github.com/redbluescreen/sbrwxmpp/scram"
+	xmlstream "github.com/redbluescreen/sbrwxmpp/xmlstream2"
+)
+
+const nsSASL = "urn:ietf:params:xml:ns:xmpp-sasl"
+
+// saslError is a SASL failure condition (RFC 6120 section 6.5)
+type saslError string
+
+const (
+	saslAborted              saslError = "aborted"
+	saslIncorrectEncoding    saslError = "incorrect-encoding"
+	saslInvalidAuthzid       saslError = "invalid-authzid"
+	saslInvalidMechanism     saslError = "invalid-mechanism"
+	saslMalformedRequest     saslError = "malformed-request"
+	saslNotAuthorized        saslError = "not-authorized"
+	saslTemporaryAuthFailure saslError = "temporary-auth-failure"
+)
+
+func (e saslError) Error() string {
+	return string(e)
+}
+
+// saslMechanism is the server side of a SASL exchange. next is called with
+// every client message and returns either a challenge, or the authenticated
+// username together with optional additional data for <success/>.
+type saslMechanism interface {
+	next(c *XmppClient, data []byte) (challenge []byte, user string, err error)
+	name() string
+}
+
+func (c *XmppClient) handleSASL(e xmlstream.Element) {
+	if c.authenticated || c.saslUser != "" {
+		c.logger.Category(log.Auth).Println("SASL negotiation after authentication")
+		c.saslFailure(saslNotAuthorized)
+		return
+	}
+	switch e.Name.Local {
+	case "auth":
+		mech := e.GetAttr("mechanism")
+		c.logger.Category(log.Auth).With(log.Fields{"mechanism": mech}).Debug("Starting SASL authentication")
+		switch mech {
+		case "PLAIN":
+			c.sasl = &plainMechanism{}
+		case "SCRAM-SHA-1":
+			c.sasl = &scramMechanism{}
+		default:
+			c.saslFailure(saslInvalidMechanism)
+			return
+		}
+		if e.Text == "" {
+			// No initial response
+			c.write("<challenge xmlns='" + nsSASL + "'/>")
+			return
+		}
+		c.saslStep(e.Text)
+	case "response":
+		if c.sasl == nil {
+			c.saslFailure(saslMalformedRequest)
+			return
+		}
+		c.saslStep(e.Text)
+	case "abort":
+		c.sasl = nil
+		c.saslFailure(saslAborted)
+	}
+}
+
+func (c *XmppClient) saslStep(text string) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if text == "=" {
+		data, err = nil, nil
+	}
+	if err != nil {
+		c.sasl = nil
+		c.saslFailure(saslIncorrectEncoding)
+		return
+	}
+	challenge, user, err := c.sasl.next(c, data)
+	if err != nil {
+		mech := c.sasl.name()
+		c.sasl = nil
+		serr, ok := err.(saslError)
+		if !ok {
+			c.logger.Category(log.Auth).Printf("error during SASL authentication: %v", err)
+			serr = saslTemporaryAuthFailure
+		} else {
+			metricAuthFailures.With(mech).Inc()
+			c.logger.Category(log.Auth).Event("auth_failed").With(log.Fields{"condition": string(serr)}).
+				Print("SASL authentication failed")
+		}
+		c.saslFailure(serr)
+		return
+	}
+	if user == "" {
+		c.write("<challenge xmlns='" + nsSASL + "'>" +
+			base64.StdEncoding.EncodeToString(challenge) + "</challenge>")
+		return
+	}
+	c.sasl = nil
+	ban, err := c.server.findBan(user, c.RemoteIP())
+	if err != nil {
+		c.logger.Category(log.Auth).Printf("error checking bans: %v", err)
+		c.saslFailure(saslTemporaryAuthFailure)
+		return
+	}
+	if ban != nil {
+		c.logger.Category(log.Auth).Event("login_banned").With(log.Fields{"user": user}).
+			Print("Rejecting login of banned user")
+		c.saslFailureText(saslNotAuthorized, banMessage(ban))
+		return
+	}
+	c.saslUser = user
+	c.logger.Category(log.Auth).With(log.Fields{"user": user}).Debug("SASL authentication succeeded")
+	if len(challenge) == 0 {
+		c.write("<success xmlns='" + nsSASL + "'/>")
+	} else {
+		c.write("<success xmlns='" + nsSASL + "'>" +
+			base64.StdEncoding.EncodeToString(challenge) + "</success>")
+	}
+	// The client restarts the stream after <success/>
+	err = c.restartStream()
+	if err != nil {
+		c.logger.Category(log.Auth).Printf("error restarting stream: %v", err)
+		c.closeConn()
+	}
+}
+
+func (c *XmppClient) saslFailure(cond saslError) {
+	c.saslFailureText(cond, "")
+}
+
+func (c *XmppClient) saslFailureText(cond saslError, text string) {
+	s := "<failure xmlns='" + nsSASL + "'><" + string(cond) + "/>"
+	if text != "" {
+		s += "<text>" + XMLEscape(text) + "</text>"
+	}
+	c.write(s + "</failure>")
+}
+
+// PLAIN (RFC 4616)
+type plainMechanism struct{}
+
+func (m *plainMechanism) name() string {
+	return "PLAIN"
+}
+
+func (m *plainMechanism) next(c *XmppClient, data []byte) ([]byte, string, error) {
+	parts := bytes.Split(data, []byte{0})
+	if len(parts) != 3 {
+		return nil, "", saslMalformedRequest
+	}
+	authzid, user, password := string(parts[0]), string(parts[1]), string(parts[2])
+	if authzid != "" && authzid != user && authzid != user+"@"+c.server.Config.Get().Domain {
+		return nil, "", saslInvalidAuthzid
+	}
+	ok, err := c.server.checkPassword(user, password)
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		return nil, "", saslNotAuthorized
+	}
+	return nil, user, nil
+}
+
+// SCRAM-SHA-1 (RFC 5802), without channel binding
+type scramMechanism struct {
+	user            string
+	keys            scram.Keys
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+}
+
+func (m *scramMechanism) name() string {
+	return "SCRAM-SHA-1"
+}
+
+func (m *scramMechanism) next(c *XmppClient, data []byte) ([]byte, string, error) {
+	if m.serverFirst == "" {
+		return m.clientFirst(c, string(data))
+	}
+	return m.clientFinal(string(data))
+}
+
+func (m *scramMechanism) clientFirst(c *XmppClient, msg string) ([]byte, string, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, "", saslMalformedRequest
+	}
+	if parts[0] != "n" && parts[0] != "y" {
+		// We don't offer SCRAM-SHA-1-PLUS
+		return nil, "", saslMalformedRequest
+	}
+	m.gs2Header = parts[0] + "," + parts[1] + ","
+	m.clientFirstBare = parts[2]
+	attrs := scramAttrs(m.clientFirstBare)
+	user, ok := scramUnescape(attrs["n"])
+	if !ok || user == "" || attrs["r"] == "" || attrs["m"] != "" {
+		return nil, "", saslMalformedRequest
+	}
+	if parts[1] != "" && parts[1] != "a="+attrs["n"] {
+		return nil, "", saslInvalidAuthzid
+	}
+	keys, found, err := c.server.scramKeys(user)
+	if err != nil {
+		return nil, "", err
+	}
+	if !found {
+		// Continue with keys nobody knows the password for, so unknown
+		// users can't be told apart from wrong passwords
+		salt := c.server.unknownUserSalt(user)
+		keys = scram.DeriveKeys([]byte(RandomStringSecure(32)), salt, scram.DefaultIterations)
+	}
+	m.user = user
+	m.keys = keys
+	m.nonce = attrs["r"] + RandomStringSecure(24)
+	m.serverFirst = "r=" + m.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(keys.Salt) +
+		",i=" + strconv.Itoa(keys.Iterations)
+	return []byte(m.serverFirst), "", nil
+}
+
+func (m *scramMechanism) clientFinal(msg string) ([]byte, string, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i == -1 {
+		return nil, "", saslMalformedRequest
+	}
+	withoutProof := msg[:i]
+	attrs := scramAttrs(withoutProof)
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(m.gs2Header)) || attrs["r"] != m.nonce {
+		return nil, "", saslMalformedRequest
+	}
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil {
+		return nil, "", saslIncorrectEncoding
+	}
+	authMessage := m.clientFirstBare + "," + m.serverFirst + "," + withoutProof
+	signature, ok := m.keys.VerifyProof([]byte(authMessage), proof)
+	if !ok {
+		return nil, "", saslNotAuthorized
+	}
+	return []byte("v=" + base64.StdEncoding.EncodeToString(signature)), m.user, nil
+}
+
+func scramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		attrs[attr[:1]] = attr[2:]
+	}
+	return attrs
+}
+
+func scramUnescape(name string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			b.WriteByte(name[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(name[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", false
+		}
+		i += 2
+	}
+	return b.String(), true
+}
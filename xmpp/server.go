@@ -5,159 +5,201 @@
 package xmpp
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/redbluescreen/sbrwxmpp/chatlog"
 	"github.com/redbluescreen/sbrwxmpp/cmdhook"
 	"github.com/redbluescreen/sbrwxmpp/config"
 	"github.com/redbluescreen/sbrwxmpp/db"
+	"github.com/redbluescreen/sbrwxmpp/events"
 	"github.com/redbluescreen/sbrwxmpp/log"
 	"github.com/redbluescreen/sbrwxmpp/tls"
 	xmlstream "github.com/redbluescreen/sbrwxmpp/xmlstream2"
 )
 
-type XmppRoom struct {
-	JID     string
-	Members []*XmppClient
-}
+type XmppServer struct {
+	sessions   sessionRegistry
+	rooms      roomRegistry
+	Logger     *log.Logger
+	Config     *config.Store
+	DB         *db.DB
+	IqHandlers *IqRegistry
+	ChatLog    *chatlog.ChatLog
+	Events     *events.Bus
 
-func (r *XmppRoom) RouteMessage(msg xmlstream.Element) {
-	nick := strings.Split(msg.GetAttr("from"), "@")[0]
-	msg.SetAttr("from", r.JID+"/"+nick)
-	for _, member := range r.Members {
-		msg.SetAttr("to", member.JID)
-		member.SendXML(msg)
-	}
-}
+	// configRooms holds the options of the rooms in the configuration by
+	// lower case JID. It is set before accepting connections.
+	configRooms map[string]db.RoomOptions
 
-func (r *XmppRoom) AddMember(c *XmppClient) {
-	for _, member := range r.Members {
-		if member == c {
-			return
-		}
-	}
-	r.Members = append(r.Members, c)
+	// saltSecret derives the salts presented for unknown users
+	saltSecret []byte
+	saltOnce   sync.Once
+
+	connsMu  sync.Mutex
+	conns    map[*XmppClient]struct{}
+	connWg   sync.WaitGroup
+	listener net.Listener
+	closing  uint32
 }
 
-func (r *XmppRoom) RemoveMember(c *XmppClient) {
-	for _, member := range r.Members {
-		str := "<presence from='%v' to='%v' type='unavailable'>" +
-			"<x xmlns='http://jabber.org/protocol/muc#user'>" +
-			"<item affiliation='member' role='none'/>"
-		if member == c {
-			str += "<status code='110'/>"
-		}
-		str += "</x></presence>"
-		nick := strings.Split(c.JID, "@")[0]
-		member.Write(fmt.Sprintf(str, XMLEscape(r.JID+"/"+nick), XMLEscape(member.JID)))
+// Run accepts connections until ctx is done or Shutdown is called
+func (s *XmppServer) Run(ctx context.Context, ln net.Listener, tlsConfig *tls.Config) error {
+	if s.IqHandlers == nil {
+		s.IqHandlers = NewIqRegistry()
 	}
-	for i, member := range r.Members {
-		if member == c {
-			j := len(r.Members) - 1
-			r.Members[i] = r.Members[j]
-			r.Members[j] = nil
-			r.Members = r.Members[:j]
-			return
-		}
+	s.IqHandlers.Register(nsIqAuth, "query", iqAuthHandler)
+	s.IqHandlers.Register(nsBind, "bind", iqBindHandler)
+	s.IqHandlers.Register(nsSession, "session", iqSessionHandler)
+	s.IqHandlers.Register(nsMUCAdmin, "query", mucAdminHandler)
+	err := s.openRooms()
+	if err != nil {
+		ln.Close()
+		return fmt.Errorf("error opening rooms: %v", err)
 	}
-}
-
-type XmppServer struct {
-	sync.Mutex
-	Clients []*XmppClient
-	Rooms   []*XmppRoom
-	Logger  *log.Logger
-	Config  *config.Config
-	DB      *db.DB
-}
-
-func (s *XmppServer) Run(ln net.Listener, tlsConfig *tls.Config) {
+	s.connsMu.Lock()
+	s.listener = ln
+	closing := atomic.LoadUint32(&s.closing) != 0
+	s.connsMu.Unlock()
+	if closing {
+		ln.Close()
+		return nil
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-stop:
+		}
+	}()
+	var backoff time.Duration
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			panic(err)
+			if ctx.Err() != nil || atomic.LoadUint32(&s.closing) != 0 {
+				return nil
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff *= 2; backoff > time.Second {
+					backoff = time.Second
+				}
+				s.Logger.Printf("error accepting connection: %v; retrying in %v", err, backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+		queueSize := s.Config.Get().Outbound.QueueSize
+		if queueSize <= 0 {
+			queueSize = defaultQueueSize
 		}
-		clogger := log.New("[unknown] ", s.Config.Verbose)
-		clogger.Println("Accepted TCP connection")
+		clogger := log.NewCategory(log.Connections, "[unknown] ")
+		clogger.SetField(log.FieldRemoteAddr, conn.RemoteAddr().String())
+		clogger.Event("connection_accepted").Print("Accepted TCP connection")
 
 		cl := &XmppClient{
-			tcpConn:   conn,
-			tlsConfig: tlsConfig,
-			logger:    clogger,
-			server:    s,
-			streamEnd: make(chan struct{}),
+			connectedAt: time.Now(),
+			tlsConfig:   tlsConfig,
+			logger:      clogger,
+			server:      s,
+			streamEnd:   make(chan struct{}, 1),
+			queue:       newSendQueue(queueSize),
+			writerQuit:  make(chan struct{}),
+			writerDone:  make(chan struct{}),
+			overflow:    make(chan struct{}),
 			webhook: &cmdhook.CmdHook{
 				Client: &http.Client{Timeout: 1 * time.Second},
-				Config: &s.Config.Webhook,
+				Config: s.Config,
+				Logger: clogger.Category(log.Webhook),
 			},
 		}
-		go cl.HandleConnection()
+		cl.tcpConn = countingConn{Conn: conn, stats: &cl.stats}
+		if !s.trackConn(cl) {
+			conn.Close()
+			continue
+		}
+		metricConnectedClients.Inc()
+		go func() {
+			defer s.untrackConn(cl)
+			cl.HandleConnection()
+		}()
 	}
 }
 
 func (s *XmppServer) RouteMessage(msg xmlstream.Element) {
-	s.Logger.Debug("Routing message")
+	logger := s.Logger.Category(log.Routing)
+	logger.Debug("Routing message")
 	to := msg.GetAttr("to")
+	typ := msg.GetAttr("type")
+	if typ == "" {
+		typ = "normal"
+	}
+	metricMessagesRouted.With(typ).Inc()
 	if msg.GetAttr("type") == "groupchat" {
-		s.Lock()
-		for _, room := range s.Rooms {
-			if strings.EqualFold(room.JID, to) {
-				s.Logger.Debug("Routing to room " + to)
-				room.RouteMessage(msg)
-				break
+		if room := s.rooms.get(to); room != nil {
+			logger.With(log.Fields{"to": to}).Debug("Routing to room")
+			room.RouteMessage(msg)
+		}
+	} else if i := strings.Index(to, "/"); i != -1 {
+		if room := s.rooms.get(to[:i]); room != nil {
+			logger.With(log.Fields{"to": to}).Debug("Routing to occupant")
+			err := room.RoutePrivateMessage(msg, to[i+1:])
+			if serr, ok := err.(StanzaError); ok && typ != "error" {
+				if sender := s.sessions.lookup(msg.GetAttr("from")); sender != nil {
+					sender.sendMessageError(msg, serr)
+				}
 			}
+			return
 		}
-		s.Unlock()
 	}
-	s.Lock()
-	for _, client := range s.Clients {
-		if jidMatches(to, client.JID) {
-			s.Logger.Debug("Routing to " + to)
-			client.SendXML(msg)
-			break
-		}
+	if client := s.sessions.lookup(to); client != nil {
+		logger.With(log.Fields{"to": to}).Debug("Routing to client")
+		client.SendXML(msg)
 	}
-	s.Unlock()
 }
 
+// AddClient makes a client available for routing
 func (s *XmppServer) AddClient(c *XmppClient) {
-	s.Lock()
-	defer s.Unlock()
-	for _, client := range s.Clients {
-		if client == c {
-			return
-		}
-	}
-	s.Clients = append(s.Clients, c)
+	s.sessions.add(c)
 }
 
+// RemoveClient removes a client from all rooms and from routing
 func (s *XmppServer) RemoveClient(c *XmppClient) {
-	s.Lock()
-	for _, room := range s.Rooms {
-		room.RemoveMember(c)
-	}
-	for i, member := range s.Clients {
-		if member == c {
-			j := len(s.Clients) - 1
-			s.Clients[i] = s.Clients[j]
-			s.Clients[j] = nil
-			s.Clients = s.Clients[:j]
-			break
-		}
+	for _, room := range c.JoinedRooms() {
+		s.leaveRoom(room, c, mucPresence{}, "")
 	}
-	s.Unlock()
+	s.sessions.remove(c)
 }
 
-func jidMatches(a, b string) bool {
-	if strings.Contains(a, "/") {
-		return a == b
-	}
-	jidParts := strings.Split(b, "/")
-	return a == jidParts[0]
+// Sessions returns a snapshot of all available clients
+func (s *XmppServer) Sessions() []*XmppClient {
+	return s.sessions.all()
+}
+
+// UserSessions returns the available clients of a bare JID
+func (s *XmppServer) UserSessions(bare string) []*XmppClient {
+	return s.sessions.find(bare)
+}
+
+// Rooms returns a snapshot of all rooms
+func (s *XmppServer) Rooms() []*XmppRoom {
+	return s.rooms.all()
+}
+
+// Room returns the room with the given JID, or nil
+func (s *XmppServer) Room(jid string) *XmppRoom {
+	return s.rooms.get(jid)
 }
 
 func BareJidMatch(a, b string) bool {
@@ -165,3 +207,11 @@ func BareJidMatch(a, b string) bool {
 	pb := strings.Split(b, "/")
 	return strings.EqualFold(pa[0], pb[0])
 }
+
+// NodeValid returns whether s can be used as the local part of a JID
+func NodeValid(s string) bool {
+	if len(s) == 0 || len(s) > 256 {
+		return false
+	}
+	return !strings.ContainsAny(s, "\"&'/:<>@\u007F\uFFFE\uFFFF")
+}
@@ -0,0 +1,83 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/redbluescreen/sbrwxmpp/chatlog"
+)
+
+// trackConn registers a connection so Shutdown can close it. It returns
+// false if the server is shutting down.
+func (s *XmppServer) trackConn(c *XmppClient) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if atomic.LoadUint32(&s.closing) != 0 {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*XmppClient]struct{})
+	}
+	s.conns[c] = struct{}{}
+	s.connWg.Add(1)
+	return true
+}
+
+func (s *XmppServer) untrackConn(c *XmppClient) {
+	s.connsMu.Lock()
+	delete(s.conns, c)
+	s.connsMu.Unlock()
+	s.connWg.Done()
+}
+
+// Shutdown stops accepting connections, announces the shutdown to all
+// players if a message is configured and closes every stream with a
+// system-shutdown error. It waits until all connections are closed and
+// their queues are flushed. If ctx is done first, the remaining
+// connections are closed forcibly and ctx.Err() is returned.
+func (s *XmppServer) Shutdown(ctx context.Context) error {
+	s.connsMu.Lock()
+	atomic.StoreUint32(&s.closing, 1)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	clients := make([]*XmppClient, 0, len(s.conns))
+	for c := range s.conns {
+		clients = append(clients, c)
+	}
+	s.connsMu.Unlock()
+
+	cfg := s.Config.Get()
+	if msg := cfg.Shutdown.Message; msg != "" {
+		body := XMLEscape(chatlog.SystemMessage(msg))
+		for _, c := range s.Sessions() {
+			c.write(fmt.Sprintf("<message type='chat' from='%v' to='%v'><body>%v</body></message>",
+				XMLEscape(cfg.Domain), XMLEscape(c.JID), body))
+		}
+	}
+	s.Logger.Printf("Closing %v connections", len(clients))
+	for _, c := range clients {
+		go c.CloseError("<system-shutdown xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.connWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, c := range clients {
+			c.closeConn()
+		}
+		<-done
+		return ctx.Err()
+	}
+}
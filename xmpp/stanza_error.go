@@ -0,0 +1,89 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"fmt"
+)
+
+const nsStanzas = "urn:ietf:params:xml:ns:xmpp-stanzas"
+
+// Error types as defined in RFC 6120 section 8.3.2
+const (
+	ErrorTypeAuth     = "auth"
+	ErrorTypeCancel   = "cancel"
+	ErrorTypeContinue = "continue"
+	ErrorTypeModify   = "modify"
+	ErrorTypeWait     = "wait"
+)
+
+// StanzaError is an XMPP stanza error (RFC 6120 section 8.3). It implements
+// error so it can be returned from IQ handlers.
+type StanzaError struct {
+	Type      string
+	Condition string
+	// Code is the legacy error code from XEP-0086, omitted when zero
+	Code int
+	Text string
+}
+
+// Defined conditions from RFC 6120 section 8.3.3 with their default
+// error types and legacy codes.
+var (
+	ErrBadRequest            = StanzaError{Type: ErrorTypeModify, Condition: "bad-request", Code: 400}
+	ErrConflict              = StanzaError{Type: ErrorTypeCancel, Condition: "conflict", Code: 409}
+	ErrFeatureNotImplemented = StanzaError{Type: ErrorTypeCancel, Condition: "feature-not-implemented", Code: 501}
+	ErrForbidden             = StanzaError{Type: ErrorTypeAuth, Condition: "forbidden", Code: 403}
+	ErrGone                  = StanzaError{Type: ErrorTypeCancel, Condition: "gone", Code: 302}
+	ErrInternalServerError   = StanzaError{Type: ErrorTypeCancel, Condition: "internal-server-error", Code: 500}
+	ErrItemNotFound          = StanzaError{Type: ErrorTypeCancel, Condition: "item-not-found", Code: 404}
+	ErrJIDMalformed          = StanzaError{Type: ErrorTypeModify, Condition: "jid-malformed", Code: 400}
+	ErrNotAcceptable         = StanzaError{Type: ErrorTypeModify, Condition: "not-acceptable", Code: 406}
+	ErrNotAllowed            = StanzaError{Type: ErrorTypeCancel, Condition: "not-allowed", Code: 405}
+	ErrNotAuthorized         = StanzaError{Type: ErrorTypeAuth, Condition: "not-authorized", Code: 401}
+	ErrPolicyViolation       = StanzaError{Type: ErrorTypeModify, Condition: "policy-violation"}
+	ErrRecipientUnavailable  = StanzaError{Type: ErrorTypeWait, Condition: "recipient-unavailable", Code: 404}
+	ErrRedirect              = StanzaError{Type: ErrorTypeModify, Condition: "redirect", Code: 302}
+	ErrRegistrationRequired  = StanzaError{Type: ErrorTypeAuth, Condition: "registration-required", Code: 407}
+	ErrRemoteServerNotFound  = StanzaError{Type: ErrorTypeCancel, Condition: "remote-server-not-found", Code: 404}
+	ErrRemoteServerTimeout   = StanzaError{Type: ErrorTypeWait, Condition: "remote-server-timeout", Code: 504}
+	ErrResourceConstraint    = StanzaError{Type: ErrorTypeWait, Condition: "resource-constraint", Code: 500}
+	ErrServiceUnavailable    = StanzaError{Type: ErrorTypeCancel, Condition: "service-unavailable", Code: 503}
+	ErrSubscriptionRequired  = StanzaError{Type: ErrorTypeAuth, Condition: "subscription-required", Code: 407}
+	ErrUndefinedCondition    = StanzaError{Type: ErrorTypeCancel, Condition: "undefined-condition", Code: 500}
+	ErrUnexpectedRequest     = StanzaError{Type: ErrorTypeWait, Condition: "unexpected-request", Code: 400}
+)
+
+func (e StanzaError) Error() string {
+	if e.Text != "" {
+		return e.Condition + ": " + e.Text
+	}
+	return e.Condition
+}
+
+// WithText returns a copy of the error with a human readable description.
+func (e StanzaError) WithText(text string) StanzaError {
+	e.Text = text
+	return e
+}
+
+// WithType returns a copy of the error with a different error type.
+func (e StanzaError) WithType(typ string) StanzaError {
+	e.Type = typ
+	return e
+}
+
+// XML returns the <error/> child element for the stanza.
+func (e StanzaError) XML() string {
+	s := "<error type='" + XMLEscape(e.Type) + "'"
+	if e.Code != 0 {
+		s += fmt.Sprintf(" code='%v'", e.Code)
+	}
+	s += "><" + e.Condition + " xmlns='" + nsStanzas + "'/>"
+	if e.Text != "" {
+		s += "<text xmlns='" + nsStanzas + "'>" + XMLEscape(e.Text) + "</text>"
+	}
+	return s + "</error>"
+}
@@ -0,0 +1,23 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import "testing"
+
+func TestStanzaErrorXML(t *testing.T) {
+	s := ErrNotAuthorized.XML()
+	expected := "<error type='auth' code='401'>" +
+		"<not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error>"
+	if s != expected {
+		t.Fatalf("unexpected error xml: %v", s)
+	}
+	s = ErrPolicyViolation.WithText("<muted>").XML()
+	expected = "<error type='modify'>" +
+		"<policy-violation xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>" +
+		"<text xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'>&lt;muted&gt;</text></error>"
+	if s != expected {
+		t.Fatalf("unexpected error xml: %v", s)
+	}
+}
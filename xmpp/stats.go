@@ -0,0 +1,97 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package xmpp
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// clientStats are updated by the goroutines of a connection and read
+// atomically by the API
+type clientStats struct {
+	bytesIn    uint64
+	bytesOut   uint64
+	stanzasIn  uint64
+	stanzasOut uint64
+	// lastActivity is the time of the last received stanza in unix
+	// nanoseconds
+	lastActivity  int64
+	tlsVersion    uint32
+	tlsCipher     uint32
+	authenticated uint32
+	// jid is a copy of the client's JID for readers on other goroutines
+	jid atomic.Value // string
+}
+
+// countingConn counts the bytes read from and written to a connection
+type countingConn struct {
+	net.Conn
+	stats *clientStats
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.stats.bytesIn, uint64(n))
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.stats.bytesOut, uint64(n))
+	return n, err
+}
+
+func (s *clientStats) stanzaReceived() {
+	atomic.AddUint64(&s.stanzasIn, 1)
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+// SessionInfo describes a connected client
+type SessionInfo struct {
+	JID           string
+	Resource      string
+	IP            string
+	ConnectedAt   time.Time
+	Authenticated bool
+	// TLSVersion and TLSCipher are empty before STARTTLS
+	TLSVersion   string
+	TLSCipher    string
+	Rooms        []*XmppRoom
+	BytesIn      uint64
+	BytesOut     uint64
+	StanzasIn    uint64
+	StanzasOut   uint64
+	LastActivity time.Time
+}
+
+// Info returns a snapshot of the state and counters of the client
+func (c *XmppClient) Info() SessionInfo {
+	jid, _ := c.stats.jid.Load().(string)
+	info := SessionInfo{
+		JID:           jid,
+		IP:            c.RemoteIP(),
+		ConnectedAt:   c.connectedAt,
+		Authenticated: atomic.LoadUint32(&c.stats.authenticated) != 0,
+		Rooms:         c.JoinedRooms(),
+		BytesIn:       atomic.LoadUint64(&c.stats.bytesIn),
+		BytesOut:      atomic.LoadUint64(&c.stats.bytesOut),
+		StanzasIn:     atomic.LoadUint64(&c.stats.stanzasIn),
+		StanzasOut:    atomic.LoadUint64(&c.stats.stanzasOut),
+	}
+	if i := strings.Index(info.JID, "/"); i >= 0 {
+		info.Resource = info.JID[i+1:]
+	}
+	if version := atomic.LoadUint32(&c.stats.tlsVersion); version != 0 {
+		info.TLSVersion = tlsVersionLabel(uint16(version))
+		info.TLSCipher = tlsCipherLabel(uint16(atomic.LoadUint32(&c.stats.tlsCipher)))
+	}
+	if t := atomic.LoadInt64(&c.stats.lastActivity); t != 0 {
+		info.LastActivity = time.Unix(0, t)
+	}
+	return info
+}